@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type InstanceBlock struct {
+	Domain    string `json:"domain" db:"domain"`
+	Reason    string `json:"reason,omitempty" db:"reason"`
+	CreatedAt string `json:"created_at" db:"created_at"`
+}
+
+// adminName is who is making an admin request: one of the users listed in
+// ADMINS, with a token signed by their key carrying an "admin" claim, or
+// "token" for requests using ADMIN_TOKEN. it is empty for everybody else.
+func (s *Server) adminName(r *http.Request) string {
+	token := r.Header.Get("Token")
+	if token == "" {
+		return ""
+	}
+
+	if s.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) == 1 {
+		return "token"
+	}
+
+	// find out who says they signed it before checking the signature
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Owner string `json:"owner"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || !contains(s.Admins, claims.Owner) {
+		return ""
+	}
+
+	err = s.validateJWT(r.Context(), token, claims.Owner, map[string]interface{}{
+		"owner": claims.Owner,
+		"admin": true,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("admin", claims.Owner).Msg("invalid admin token")
+		return ""
+	}
+	return claims.Owner
+}
+
+func (s *Server) isAdmin(r *http.Request) bool {
+	return s.adminName(r) != ""
+}
+
+// requireAdmin wraps handlers that only admins can use. the admin name is
+// passed along so actions can be recorded in the audit log.
+func (s *Server) requireAdmin(
+	next func(w http.ResponseWriter, r *http.Request, admin string),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := s.adminName(r)
+		if admin == "" {
+			http.Error(w, "Unauthorized.", 401)
+			return
+		}
+		next(w, r, admin)
+	}
+}
+
+func (s *Server) audit(ctx context.Context, admin, action, target, reason string) {
+	err := s.store.AddAuditEntry(ctx, AuditEntry{
+		Admin:  admin,
+		Action: action,
+		Target: target,
+		Reason: reason,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("admin", admin).Str("action", action).
+			Str("target", target).Msg("failed to write to the audit log")
+	}
+}
+
+// adminReason reads the optional {"reason": "..."} body of admin actions.
+func adminReason(r *http.Request) string {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	return body.Reason
+}
+
+func (s *Server) adminListUsers(w http.ResponseWriter, r *http.Request, admin string) {
+	accounts, err := s.store.ListAccounts(r.Context())
+	if err != nil {
+		log.Warn().Err(err).Msg("error listing users")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+func (s *Server) adminSuspendUser(w http.ResponseWriter, r *http.Request, admin string) {
+	owner := mux.Vars(r)["owner"]
+	suspend := mux.Vars(r)["action"] == "suspend"
+	reason := adminReason(r)
+
+	err := s.store.SuspendUser(r.Context(), owner, suspend, reason)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error suspending user")
+		http.Error(w, "Error updating user: "+err.Error(), 500)
+		return
+	}
+
+	s.audit(r.Context(), admin, mux.Vars(r)["action"], owner, reason)
+	w.WriteHeader(200)
+}
+
+func (s *Server) adminDeleteUser(w http.ResponseWriter, r *http.Request, admin string) {
+	owner := mux.Vars(r)["owner"]
+	reason := adminReason(r)
+
+	followers, err := s.store.DeleteUser(r.Context(), owner)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error deleting user")
+		http.Error(w, "Error deleting user: "+err.Error(), 500)
+		return
+	}
+
+	// queue for delivery to the activitypub followers they had
+	s.pubDispatchActorDelete(owner, followers)
+
+	s.audit(r.Context(), admin, "delete_user", owner, reason)
+	w.WriteHeader(200)
+}
+
+// adminSetRecordState hides, takes down or restores a record.
+func (s *Server) adminSetRecordState(w http.ResponseWriter, r *http.Request, admin string) {
+	owner := mux.Vars(r)["owner"]
+	name := mux.Vars(r)["name"]
+
+	var body struct {
+		State  string `json:"state"`
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch body.State {
+	case RecordVisible, RecordHidden, RecordTakenDown:
+	default:
+		http.Error(w, "State must be visible, hidden or taken_down.", 400)
+		return
+	}
+
+	err := s.changeRecordState(r.Context(), admin, owner, name, body.State, body.Reason)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Record not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("error setting record state")
+		http.Error(w, "Error updating record: "+err.Error(), 500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// changeRecordState also keeps the cid denylist in sync: the current cid of
+// a record taken down can't be published again until it is restored.
+func (s *Server) changeRecordState(ctx context.Context, admin, owner, name, state, reason string) error {
+	err := s.store.SetRecordState(ctx, owner, name, state, reason)
+	if err != nil {
+		return err
+	}
+
+	s.audit(ctx, admin, "record_"+state, owner+"/"+name, reason)
+	return nil
+}
+
+func (s *Server) adminAuditLog(w http.ResponseWriter, r *http.Request, admin string) {
+	entries, err := s.store.ListAuditLog(r.Context(), 200)
+	if err != nil {
+		log.Warn().Err(err).Msg("error fetching audit log")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *Server) adminListBlocks(w http.ResponseWriter, r *http.Request, admin string) {
+	blocks := make([]InstanceBlock, 0)
+	err := s.pg.SelectContext(r.Context(), &blocks, `
+        SELECT domain, reason, created_at FROM instance_blocks ORDER BY domain
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("error fetching instance blocks")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+func (s *Server) adminBlockDomain(w http.ResponseWriter, r *http.Request, admin string) {
+	domain := strings.ToLower(mux.Vars(r)["domain"])
+	reason := adminReason(r)
+
+	_, err := s.pg.ExecContext(r.Context(), `
+        INSERT INTO instance_blocks (domain, reason) VALUES ($1, $2)
+        ON CONFLICT (domain) DO UPDATE SET reason = $2
+    `, domain, reason)
+	if err != nil {
+		log.Warn().Err(err).Str("domain", domain).Msg("error blocking domain")
+		http.Error(w, "Error blocking domain: "+err.Error(), 500)
+		return
+	}
+
+	// nobody here gets to be followed from there anymore
+	_, err = s.pg.ExecContext(r.Context(), `
+        DELETE FROM pub_user_followers
+        WHERE follower LIKE 'https://' || $1 || '/%'
+           OR follower LIKE 'https://%.' || $1 || '/%'
+    `, domain)
+	if err != nil {
+		log.Warn().Err(err).Str("domain", domain).Msg("error removing blocked followers")
+	}
+
+	s.audit(r.Context(), admin, "block_domain", domain, reason)
+	w.WriteHeader(200)
+}
+
+func (s *Server) adminUnblockDomain(w http.ResponseWriter, r *http.Request, admin string) {
+	domain := strings.ToLower(mux.Vars(r)["domain"])
+
+	_, err := s.pg.ExecContext(r.Context(), `
+        DELETE FROM instance_blocks WHERE domain = $1
+    `, domain)
+	if err != nil {
+		log.Warn().Err(err).Str("domain", domain).Msg("error unblocking domain")
+		http.Error(w, "Error unblocking domain: "+err.Error(), 500)
+		return
+	}
+
+	s.audit(r.Context(), admin, "unblock_domain", domain, "")
+	w.WriteHeader(200)
+}
+
+// pubInstanceBlocked checks if the actor's domain, or any of its parent
+// domains, is blocked for the whole instance.
+func (s *Server) pubInstanceBlocked(host string) bool {
+	var blocked bool
+	err := s.pg.Get(&blocked, `
+        SELECT count(*) > 0 FROM instance_blocks
+        WHERE $1 = domain OR $1 LIKE '%.' || domain
+    `, strings.ToLower(host))
+	if err != nil {
+		log.Warn().Err(err).Str("host", host).Msg("error checking instance blocks")
+	}
+	return blocked
+}
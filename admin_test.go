@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestTakedownDenials(t *testing.T) {
+	ts := newTestServer(t)
+	bob := ts.register("bob")
+	alice := ts.register("alice")
+
+	bobx := jwt.MapClaims{"owner": "bob", "name": "x"}
+	alicey := jwt.MapClaims{"owner": "alice", "name": "y"}
+	alicez := jwt.MapClaims{"owner": "alice", "name": "z"}
+
+	ts.run([]apiTest{
+		{
+			name: "put", method: "PUT", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"cid":"` + testCID1 + `"}`, status: 200,
+		},
+		{
+			name: "put the same cid elsewhere", method: "PUT", path: "/alice/y",
+			user: alice, claims: alicey,
+			body: `{"cid":"` + testCID1 + `"}`, status: 200,
+		},
+		{
+			name: "take down without being an admin", method: "POST",
+			path: "/admin/records/bob/x/state", user: bob, claims: bobx,
+			body: `{"state":"taken_down"}`, status: 401,
+		},
+		{
+			name: "take down", method: "POST", path: "/admin/records/bob/x/state",
+			token: testAdminToken, body: `{"state":"taken_down","reason":"bad"}`, status: 200,
+		},
+		{
+			name: "take down the other", method: "POST", path: "/admin/records/alice/y/state",
+			token: testAdminToken, body: `{"state":"taken_down","reason":"bad"}`, status: 200,
+		},
+		{
+			name: "taken down cid is denied", method: "PUT", path: "/alice/z",
+			user: alice, claims: alicez,
+			body: `{"cid":"` + testCID1 + `"}`, status: 451,
+		},
+		{
+			name: "restore", method: "POST", path: "/admin/records/bob/x/state",
+			token: testAdminToken, body: `{"state":"visible"}`, status: 200,
+		},
+		{
+			name: "still denied by the other takedown", method: "PUT", path: "/alice/z",
+			user: alice, claims: alicez,
+			body: `{"cid":"` + testCID1 + `"}`, status: 451,
+		},
+		{
+			name: "deny by hand", method: "PUT", path: "/admin/denylist/" + testCID1,
+			token: testAdminToken, status: 200,
+		},
+		{
+			name: "restore the other", method: "POST", path: "/admin/records/alice/y/state",
+			token: testAdminToken, body: `{"state":"visible"}`, status: 200,
+		},
+		{
+			name: "still denied by hand", method: "PUT", path: "/alice/z",
+			user: alice, claims: alicez,
+			body: `{"cid":"` + testCID1 + `"}`, status: 451,
+		},
+		{
+			name: "allow", method: "DELETE", path: "/admin/denylist/" + testCID1,
+			token: testAdminToken, status: 200,
+		},
+		{
+			name: "allowed", method: "PUT", path: "/alice/z",
+			user: alice, claims: alicez,
+			body: `{"cid":"` + testCID1 + `"}`, status: 200,
+		},
+		{
+			name: "restore a missing record", method: "POST", path: "/admin/records/bob/nothing/state",
+			token: testAdminToken, body: `{"state":"visible"}`, status: 404,
+		},
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	ts := newTestServer(t)
+	bob := ts.register("bob")
+	alice := ts.register("alice")
+
+	ts.run([]apiTest{
+		{
+			name: "put", method: "PUT", path: "/bob/x",
+			user: bob, claims: jwt.MapClaims{"owner": "bob", "name": "x"},
+			body: `{"cid":"` + testCID1 + `"}`, status: 200,
+		},
+		{
+			name: "star", method: "PATCH", path: "/alice",
+			user: alice, claims: jwt.MapClaims{"owner": "alice"},
+			body: `{"star":"bob/x"}`, status: 200,
+		},
+		{
+			name: "offer", method: "POST", path: "/bob/x/transfer",
+			user: bob, claims: jwt.MapClaims{"owner": "bob", "name": "x"},
+			body: `{"to":"alice"}`, status: 200,
+		},
+		{
+			name: "delete without being an admin", method: "DELETE", path: "/admin/users/bob",
+			user: bob, claims: jwt.MapClaims{"owner": "bob"}, status: 401,
+		},
+		{
+			name: "delete", method: "DELETE", path: "/admin/users/bob",
+			token: testAdminToken, status: 200,
+		},
+		{
+			name: "records are gone", method: "GET", path: "/bob/x", status: 200,
+			check: expect("@this", ""),
+		},
+		{
+			name: "stars are gone", method: "GET", path: "/alice", status: 200,
+			check: expect("stars", `[]`),
+		},
+		{
+			name: "the transfer is gone", method: "POST", path: "/bob/x/transfer/accept",
+			user: alice, claims: jwt.MapClaims{"owner": "alice", "transfer": "bob/x"}, status: 404,
+		},
+		{
+			name: "nothing is listed", method: "GET", path: "/bob/", status: 200,
+			check: expect("#", 0),
+		},
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// getRecord is like store.GetRecord but also finds records by their old
+// names, setting MovedTo to where they are now.
+func (s *Server) getRecord(ctx context.Context, owner, name string, full bool) (Entry, error) {
+	entry, err := s.store.GetRecord(ctx, owner, name, full)
+	if err != sql.ErrNoRows {
+		return entry, err
+	}
+
+	newOwner, current, err := s.store.ResolveAlias(ctx, owner, name)
+	if err != nil {
+		return entry, err
+	}
+	entry, err = s.store.GetRecord(ctx, newOwner, current, full)
+	entry.MovedTo = newOwner + "/" + current
+	return entry, err
+}
+
+// setAlias adds or removes an extra name for a record. aliases are signed
+// like any other change to the record they point to.
+func (s *Server) setAlias(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+	name := mux.Vars(r)["name"]
+	alias := mux.Vars(r)["alias"]
+
+	token := r.Header.Get("Token")
+	err := s.validateJWT(r.Context(), token, owner, map[string]interface{}{
+		"owner": owner,
+		"name":  name,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Str("token", token).
+			Msg("token data is invalid")
+		http.Error(w, "Token data is invalid: "+err.Error(), 401)
+		return
+	}
+
+	if s.rateLimited(w, s.limits.userWrites, owner) {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = s.store.RemoveAlias(r.Context(), owner, name, alias)
+		if err == sql.ErrNoRows {
+			http.Error(w, alias+" isn't an alias of "+name+".", 404)
+			return
+		}
+	} else {
+		if !s.requireVerified(w, r, owner, "Confirm your email address before adding aliases.") {
+			return
+		}
+
+		if len(alias) > 50 {
+			http.Error(w, "Alias too long.", 400)
+			return
+		}
+		if !checkRecordName(w, alias) {
+			return
+		}
+
+		_, err = s.store.RecordCID(r.Context(), owner, alias)
+		if err == nil {
+			http.Error(w, "There's already a record named "+alias+".", 409)
+			return
+		} else if err != sql.ErrNoRows {
+			log.Warn().Err(err).Str("owner", owner).Str("alias", alias).
+				Msg("error fetching stuff from database")
+			http.Error(w, "Error fetching data.", 500)
+			return
+		}
+
+		err = s.store.AddAlias(r.Context(), owner, name, alias)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Record not found.", 404)
+			return
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Str("alias", alias).Msg("error setting alias")
+		http.Error(w, "Error setting alias: "+err.Error(), 500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
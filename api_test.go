@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	testCID1 = "QmQjyLocqMrwxNnz5G1UtHZrRNsztgR97jLtch7bK28BWa"
+	testCID2 = "bafybeihfg3d7rdltd43u3tfvncx7n5loqofbsobojcadtmokrljfthuc7y"
+)
+
+func TestRegister(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register("bob")
+
+	sk := newKey(t)
+	pk := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&sk.PublicKey),
+	}))
+
+	for _, test := range []struct {
+		name   string
+		owner  string
+		email  string
+		status int
+	}{
+		{"valid", "alice", "alice@example.com", 200},
+		{"taken", "bob", "bob2@example.com", 500},
+		{"reserved", "admin", "admin@example.com", 400},
+		{"reserved in another case", "Pub", "pub@example.com", 400},
+		{"looks like a feed", "carol.rss", "carol@example.com", 400},
+		{"reserved for feeds", "feed", "feed@example.com", 400},
+		{"invalid email", "carol", "carol", 400},
+		{"invalid name", "dave%3Cb%3E", "dave@example.com", 400},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := ts.do("POST", "/"+test.owner, "", pk, "Email", test.email)
+			if w.Code != test.status {
+				t.Fatalf("status %d, expected %d: %s", w.Code, test.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRecords(t *testing.T) {
+	ts := newTestServer(t)
+	bob := ts.register("bob")
+	alice := ts.register("alice")
+
+	bobx := jwt.MapClaims{"owner": "bob", "name": "x"}
+	boby := jwt.MapClaims{"owner": "bob", "name": "y"}
+
+	ts.run([]apiTest{
+		// put
+		{
+			name: "put without token", method: "PUT", path: "/bob/x",
+			body: `{"cid":"` + testCID1 + `"}`, status: 401,
+		},
+		{
+			name: "put signed by someone else", method: "PUT", path: "/bob/x",
+			user: alice, claims: bobx,
+			body: `{"cid":"` + testCID1 + `"}`, status: 401,
+		},
+		{
+			name: "put with claims for another record", method: "PUT", path: "/bob/x",
+			user: bob, claims: boby,
+			body: `{"cid":"` + testCID1 + `"}`, status: 401,
+		},
+		{
+			name: "put invalid cid", method: "PUT", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"cid":"nothing"}`, status: 400,
+		},
+		{
+			name: "put with markup in the name", method: "PUT", path: "/bob/%3Cb%3Ex",
+			user: bob, claims: jwt.MapClaims{"owner": "bob", "name": "<b>x"},
+			body: `{"cid":"` + testCID1 + `"}`, status: 400,
+		},
+		{
+			name: "put with a reserved name", method: "PUT", path: "/bob/timeline",
+			user: bob, claims: jwt.MapClaims{"owner": "bob", "name": "timeline"},
+			body: `{"cid":"` + testCID1 + `"}`, status: 400,
+		},
+		{
+			name: "put with a feed suffix", method: "PUT", path: "/bob/x.atom",
+			user: bob, claims: jwt.MapClaims{"owner": "bob", "name": "x.atom"},
+			body: `{"cid":"` + testCID1 + `"}`, status: 400,
+		},
+		{
+			name: "put too large", method: "PUT", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"cid":"` + testCID1 + `","note":"` + strings.Repeat("a", 2<<20) + `"}`, status: 413,
+		},
+		{
+			name: "put", method: "PUT", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"cid":"` + testCID1 + `","note":"first"}`, status: 200,
+		},
+
+		// get
+		{
+			name: "get", method: "GET", path: "/bob/x", status: 200,
+			check: all(expect("cid", testCID1), expect("note", "first"), expect("nstars", 0)),
+		},
+		{
+			name: "redirect", method: "GET", path: "/r/bob/x", status: 302,
+			check: func(t *testing.T, body string) {
+				if !strings.Contains(body, `href="http://127.0.0.1:1/ipfs/`+testCID1+`"`) {
+					t.Errorf("not redirected to the gateway: %s", body)
+				}
+			},
+		},
+		{
+			name: "get missing", method: "GET", path: "/bob/nothing", status: 200,
+			check: expect("@this", ""),
+		},
+		{
+			name: "list", method: "GET", path: "/bob/", status: 200,
+			check: all(expect("#", 1), expect("0.name", "x")),
+		},
+
+		// history
+		{
+			name: "put again", method: "PUT", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"cid":"` + testCID2 + `","note":"second"}`, status: 200,
+		},
+		{
+			name: "put the same cid", method: "PUT", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"cid":"` + testCID2 + `","note":"second"}`, status: 200,
+		},
+		{
+			name: "history", method: "GET", path: "/bob/x?full=1", status: 200,
+			check: all(
+				expect("cid", testCID2),
+				expect("history.#", 2),
+				expect("history.0.cid", testCID2),
+				expect("history.1.cid", testCID1),
+			),
+		},
+
+		// cid query
+		{
+			name: "cid query", method: "GET", path: "/?cid=" + testCID1, status: 200,
+			check: all(expect("#", 1), expect("0.owner", "bob"), expect("0.name", "x")),
+		},
+		{
+			name: "cid query with /ipfs/", method: "GET", path: "/?cid=/ipfs/" + testCID2, status: 200,
+			check: expect("#", 1),
+		},
+		{
+			name: "cid query for a user", method: "GET", path: "/alice?cid=" + testCID1, status: 200,
+			check: expect("#", 0),
+		},
+
+		// stars
+		{
+			name: "star signed by someone else", method: "PATCH", path: "/alice",
+			user: bob, claims: jwt.MapClaims{"owner": "alice"},
+			body: `{"star":"bob/x"}`, status: 401,
+		},
+		{
+			name: "star with a number", method: "PATCH", path: "/alice",
+			user: alice, claims: jwt.MapClaims{"owner": "alice"},
+			body: `{"star":1}`, status: 400,
+		},
+		{
+			name: "star without a name", method: "PATCH", path: "/alice",
+			user: alice, claims: jwt.MapClaims{"owner": "alice"},
+			body: `{"star":"bob"}`, status: 400,
+		},
+		{
+			name: "follow with null", method: "PATCH", path: "/alice",
+			user: alice, claims: jwt.MapClaims{"owner": "alice"},
+			body: `{"follow":null}`, status: 400,
+		},
+		{
+			name: "star", method: "PATCH", path: "/alice",
+			user: alice, claims: jwt.MapClaims{"owner": "alice"},
+			body: `{"star":"bob/x"}`, status: 200,
+		},
+		{
+			name: "stars of the user", method: "GET", path: "/alice", status: 200,
+			check: expect("stars", `["bob/x"]`),
+		},
+		{
+			name: "stars of the record", method: "GET", path: "/bob/x", status: 200,
+			check: expect("nstars", 1),
+		},
+
+		// rename
+		{
+			name: "rename to an invalid name", method: "PATCH", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"name":"x\"><script>"}`, status: 400,
+		},
+		{
+			name: "rename", method: "PATCH", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"name":"y"}`, status: 200,
+		},
+		{
+			name: "get renamed", method: "GET", path: "/bob/y", status: 200,
+			check: all(expect("name", "y"), expect("cid", testCID2), expect("nstars", 1)),
+		},
+		{
+			name: "get by the old name", method: "GET", path: "/bob/x", status: 200,
+			check: all(expect("name", "y"), expect("moved_to", "bob/y")),
+		},
+		{
+			name: "stars follow the rename", method: "GET", path: "/alice", status: 200,
+			check: expect("stars", `["bob/y"]`),
+		},
+		{
+			name: "history follows the rename", method: "GET", path: "/bob/y?full=1", status: 200,
+			check: expect("history.#", 2),
+		},
+
+		// delete
+		{
+			name: "delete signed by someone else", method: "DELETE", path: "/bob/y",
+			user: alice, claims: boby, status: 401,
+		},
+		{
+			name: "delete", method: "DELETE", path: "/bob/y",
+			user: bob, claims: boby, status: 200,
+		},
+		{
+			name: "get deleted", method: "GET", path: "/bob/y", status: 200,
+			check: expect("@this", ""),
+		},
+		{
+			name: "old name is gone too", method: "GET", path: "/bob/x", status: 200,
+			check: expect("@this", ""),
+		},
+		{
+			name: "cid query after delete", method: "GET", path: "/?cid=" + testCID1, status: 200,
+			check: expect("#", 0),
+		},
+		{
+			name: "stars are gone", method: "GET", path: "/alice", status: 200,
+			check: expect("stars", `[]`),
+		},
+	})
+}
+
+func TestTransfers(t *testing.T) {
+	ts := newTestServer(t)
+	bob := ts.register("bob")
+	alice := ts.register("alice")
+
+	bobx := jwt.MapClaims{"owner": "bob", "name": "x"}
+	accept := jwt.MapClaims{"owner": "alice", "transfer": "bob/x"}
+
+	ts.run([]apiTest{
+		{
+			name: "put", method: "PUT", path: "/bob/x",
+			user: bob, claims: bobx,
+			body: `{"cid":"` + testCID1 + `"}`, status: 200,
+		},
+		{
+			name: "accept before the offer", method: "POST", path: "/bob/x/transfer/accept",
+			user: alice, claims: accept, status: 404,
+		},
+		{
+			name: "offer signed by someone else", method: "POST", path: "/bob/x/transfer",
+			user: alice, claims: bobx, body: `{"to":"alice"}`, status: 401,
+		},
+		{
+			name: "offer to nobody", method: "POST", path: "/bob/x/transfer",
+			user: bob, claims: bobx, body: `{"to":"nobody"}`, status: 404,
+		},
+		{
+			name: "offer", method: "POST", path: "/bob/x/transfer",
+			user: bob, claims: bobx, body: `{"to":"alice"}`, status: 200,
+		},
+		{
+			name: "accept signed by the owner", method: "POST", path: "/bob/x/transfer/accept",
+			user: bob, claims: accept, status: 401,
+		},
+		{
+			name: "accept", method: "POST", path: "/bob/x/transfer/accept",
+			user: alice, claims: accept, status: 200,
+		},
+		{
+			name: "get transferred", method: "GET", path: "/alice/x?full=1", status: 200,
+			check: all(expect("owner", "alice"), expect("cid", testCID1), expect("history.#", 1)),
+		},
+		{
+			name: "get by the old path", method: "GET", path: "/bob/x", status: 200,
+			check: expect("moved_to", "alice/x"),
+		},
+		{
+			name: "the new owner can publish", method: "PUT", path: "/alice/x",
+			user: alice, claims: jwt.MapClaims{"owner": "alice", "name": "x"},
+			body: `{"cid":"` + testCID2 + `"}`, status: 200,
+		},
+		{
+			name: "the old owner can't", method: "PUT", path: "/alice/x",
+			user: bob, claims: jwt.MapClaims{"owner": "alice", "name": "x"},
+			body: `{"cid":"` + testCID1 + `"}`, status: 401,
+		},
+		{
+			name: "history goes along", method: "GET", path: "/alice/x?full=1", status: 200,
+			check: all(expect("history.#", 2), expect("history.1.cid", testCID1)),
+		},
+	})
+}
+
+func TestActivityPub(t *testing.T) {
+	ts := newTestServer(t)
+	ts.requireFederation()
+	bob := ts.register("bob")
+
+	ts.run([]apiTest{
+		{
+			name: "put", method: "PUT", path: "/bob/x",
+			user: bob, claims: jwt.MapClaims{"owner": "bob", "name": "x"},
+			body: `{"cid":"` + testCID1 + `","note":"hello"}`, status: 200,
+		},
+		{
+			name: "webfinger", method: "GET",
+			path:   "/.well-known/webfinger?resource=acct:bob@gravity.test",
+			status: 200,
+			check: all(
+				expect("subject", "acct:bob@gravity.test"),
+				expect(`links.#(rel=="self").href`, "https://gravity.test/pub/user/bob"),
+			),
+		},
+		{
+			name: "webfinger by actor url", method: "GET",
+			path:   "/.well-known/webfinger?resource=https://gravity.test/pub/user/bob",
+			status: 200,
+		},
+		{
+			name: "webfinger for another server", method: "GET",
+			path:   "/.well-known/webfinger?resource=acct:bob@elsewhere.test",
+			status: 404,
+		},
+		{
+			name: "webfinger for a missing user", method: "GET",
+			path:   "/.well-known/webfinger?resource=acct:nobody@gravity.test",
+			status: 404,
+		},
+		{
+			name: "actor", method: "GET", path: "/pub/user/bob", status: 200,
+			check: all(
+				expect("type", "Person"),
+				expect("id", "https://gravity.test/pub/user/bob"),
+				expect("inbox", "https://gravity.test/pub"),
+				expect("publicKey.id", "https://gravity.test/pub/user/bob#main-key"),
+				expect("publicKey.owner", "https://gravity.test/pub/user/bob"),
+			),
+		},
+		{
+			name: "missing actor", method: "GET", path: "/pub/user/nobody", status: 404,
+		},
+		{
+			name: "outbox", method: "GET", path: "/pub/user/bob/outbox", status: 200,
+			check: all(
+				expect("totalItems", 1),
+				expect("first.orderedItems.0.type", "Create"),
+				expect("first.orderedItems.0.actor", "https://gravity.test/pub/user/bob"),
+				expect("first.orderedItems.0.object.attributedTo", "https://gravity.test/pub/user/bob"),
+			),
+		},
+		{
+			name: "followers", method: "GET", path: "/pub/user/bob/followers", status: 200,
+			check: expect("totalItems", 0),
+		},
+		{
+			name: "timeline without a token", method: "GET", path: "/bob/timeline", status: 401,
+		},
+		{
+			name: "timeline", method: "GET", path: "/bob/timeline",
+			user: bob, claims: jwt.MapClaims{"owner": "bob"}, status: 200,
+			check: expect("#", 0),
+		},
+		{
+			name: "nodeinfo", method: "GET", path: "/nodeinfo/2.0", status: 200,
+			check: all(expect("usage.users.total", 1), expect("protocols", `["activitypub"]`)),
+		},
+		{
+			name: "unsigned inbox request", method: "POST", path: "/pub",
+			body:   `{"type":"Follow","actor":"https://elsewhere.test/users/alice","object":"https://gravity.test/pub/user/bob"}`,
+			status: 401,
+		},
+	})
+
+	// the note is there and the outbox links to it
+	w := ts.do("GET", "/pub/user/bob/outbox", "", "")
+	id := gjson.Get(w.Body.String(), "first.orderedItems.0.object.id").String()
+	if !strings.HasPrefix(id, "https://gravity.test/pub/note/") {
+		t.Fatalf("unexpected note id %s", id)
+	}
+	ts.run([]apiTest{
+		{
+			name: "note", method: "GET", path: strings.TrimPrefix(id, "https://gravity.test"),
+			status: 200,
+			check:  all(expect("type", "Note"), expect("id", id)),
+		},
+		{
+			name: "delete", method: "DELETE", path: "/bob/x",
+			user: bob, claims: jwt.MapClaims{"owner": "bob", "name": "x"}, status: 200,
+		},
+		{
+			name: "tombstone", method: "GET", path: strings.TrimPrefix(id, "https://gravity.test"),
+			status: 410,
+			check:  expect("type", "Tombstone"),
+		},
+	})
+}
+
+// all runs every check.
+func all(checks ...func(t *testing.T, body string)) func(t *testing.T, body string) {
+	return func(t *testing.T, body string) {
+		t.Helper()
+		for _, check := range checks {
+			check(t, body)
+		}
+	}
+}
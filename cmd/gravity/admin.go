@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dghubble/sling"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/cobra"
+	"github.com/tidwall/gjson"
+)
+
+// adminRequest sends a request signed as an admin of the server. admin
+// tokens expire quickly, unlike the ones for users.
+func adminRequest(r *sling.Sling, body interface{}) ([]byte, bool) {
+	sk, err := getPrivateKey()
+	if err != nil {
+		return nil, false
+	}
+
+	token, err := makeJWT(sk, jwt.MapClaims{
+		"owner": currentUser,
+		"admin": true,
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to make JWT: "+err.Error())
+		return nil, false
+	}
+
+	req, _ := r.Set("Token", token).BodyJSON(body).Request()
+	w, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Request failed: "+err.Error())
+		return nil, false
+	}
+	b, _ := ioutil.ReadAll(w.Body)
+	if w.StatusCode >= 300 {
+		printError(w, b)
+		return nil, false
+	}
+	return b, true
+}
+
+func reasonArg(args []string) map[string]interface{} {
+	return map[string]interface{}{"reason": strings.Join(args, " ")}
+}
+
+var AdminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Manage the server, if you are one of its admins.",
+}
+
+var AdminUsersCmd = &cobra.Command{
+	Use:     "users",
+	Aliases: []string{"ls"},
+	Short:   "List all users.",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, ok := adminRequest(c.Get("/admin/users"), nil)
+		if !ok {
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		gjson.ParseBytes(b).ForEach(func(_, value gjson.Result) bool {
+			status := "unverified"
+			if value.Get("suspended_at").Type != gjson.Null {
+				status = "suspended: " + value.Get("suspension_reason").String()
+			} else if value.Get("verified_at").Type != gjson.Null {
+				status = "active"
+			}
+			fmt.Fprintln(tw, strings.Join([]string{
+				value.Get("name").String(),
+				value.Get("email").String(),
+				value.Get("nrecords").String() + " records",
+				status,
+			}, "\t"))
+			return true
+		})
+		tw.Flush()
+	},
+}
+
+var AdminSuspendCmd = &cobra.Command{
+	Use:   "suspend [username] [reason...]",
+	Short: "Stop a user from changing anything.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest(c.Post("/admin/users/"+args[0]+"/suspend"), reasonArg(args[1:]))
+	},
+}
+
+var AdminUnsuspendCmd = &cobra.Command{
+	Use:   "unsuspend [username]",
+	Short: "Lift a suspension.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest(c.Post("/admin/users/"+args[0]+"/unsuspend"), nil)
+	},
+}
+
+var AdminDelUserCmd = &cobra.Command{
+	Use:   "deluser [username] [reason...]",
+	Short: "Delete a user and all their records.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest(c.Delete("/admin/users/"+args[0]), reasonArg(args[1:]))
+	},
+}
+
+func adminRecordStateCmd(use, short, state string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " [username]/[recordname] [reason...]",
+		Short: short,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("The record is required.")
+			}
+			return validateArgKey(cmd, args)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			body := reasonArg(args[1:])
+			body["state"] = state
+			adminRequest(c.Post("/admin/records/"+args[0]+"/state"), body)
+		},
+	}
+}
+
+var AdminHideCmd = adminRecordStateCmd("hide",
+	"Hide a record from everybody.", "hidden")
+var AdminTakedownCmd = adminRecordStateCmd("takedown",
+	"Take a record down, telling everybody it was taken down.", "taken_down")
+var AdminRestoreCmd = adminRecordStateCmd("restore",
+	"Make a hidden or taken down record visible again.", "visible")
+
+var AdminLogCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Show what admins have done.",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, ok := adminRequest(c.Get("/admin/log"), nil)
+		if !ok {
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		gjson.ParseBytes(b).ForEach(func(_, value gjson.Result) bool {
+			fmt.Fprintln(tw, strings.Join([]string{
+				value.Get("created_at").String(),
+				value.Get("admin").String(),
+				value.Get("action").String(),
+				value.Get("target").String(),
+				value.Get("reason").String(),
+			}, "\t"))
+			return true
+		})
+		tw.Flush()
+	},
+}
+
+var AdminBlocksCmd = &cobra.Command{
+	Use:   "blocks",
+	Short: "List ActivityPub domains blocked for the whole server.",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, ok := adminRequest(c.Get("/admin/blocks"), nil)
+		if !ok {
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		gjson.ParseBytes(b).ForEach(func(_, value gjson.Result) bool {
+			fmt.Fprintln(tw, value.Get("domain").String()+"\t"+value.Get("reason").String())
+			return true
+		})
+		tw.Flush()
+	},
+}
+
+var AdminBlockCmd = &cobra.Command{
+	Use:   "block [domain] [reason...]",
+	Short: "Block an ActivityPub domain for the whole server.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest(c.Put("/admin/blocks/"+args[0]), reasonArg(args[1:]))
+	},
+}
+
+var AdminUnblockCmd = &cobra.Command{
+	Use:   "unblock [domain]",
+	Short: "Unblock an ActivityPub domain.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest(c.Delete("/admin/blocks/"+args[0]), nil)
+	},
+}
+
+var AdminDeliveriesCmd = &cobra.Command{
+	Use:   "deliveries",
+	Short: "Show the ActivityPub delivery queue.",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, ok := adminRequest(c.Get("/admin/deliveries"), nil)
+		if !ok {
+			return
+		}
+
+		j := gjson.ParseBytes(b)
+		fmt.Printf("%d pending, %d retrying, %d dead\n",
+			j.Get("pending").Int(), j.Get("retrying").Int(), j.Get("dead").Int())
+
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		j.Get("items").ForEach(func(_, value gjson.Result) bool {
+			status := "retry at " + value.Get("next_attempt_at").String()
+			if value.Get("dead").Bool() {
+				status = "dead"
+			}
+			fmt.Fprintln(tw, strings.Join([]string{
+				value.Get("id").String(),
+				value.Get("inbox").String(),
+				value.Get("attempts").String() + " attempts",
+				status,
+				value.Get("last_error").String(),
+			}, "\t"))
+			return true
+		})
+		tw.Flush()
+	},
+}
+
+var AdminReportsCmd = &cobra.Command{
+	Use:   "reports",
+	Short: "Show the reports waiting for a decision.",
+	Run: func(cmd *cobra.Command, args []string) {
+		path := "/admin/reports"
+		if showAll {
+			path += "?all=1"
+		}
+		b, ok := adminRequest(c.Get(path), nil)
+		if !ok {
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		gjson.ParseBytes(b).ForEach(func(_, value gjson.Result) bool {
+			status := "open"
+			if value.Get("resolution").String() != "" {
+				status = value.Get("resolution").String() + " by " + value.Get("resolved_by").String()
+			}
+			fmt.Fprintln(tw, strings.Join([]string{
+				value.Get("id").String(),
+				value.Get("owner").String() + "/" + value.Get("name").String(),
+				value.Get("category").String(),
+				status,
+				value.Get("description").String(),
+				value.Get("contact").String(),
+			}, "\t"))
+			return true
+		})
+		tw.Flush()
+	},
+}
+
+var AdminResolveCmd = &cobra.Command{
+	Use:   "resolve [report id] [dismiss|hide|takedown] [reason...]",
+	Short: "Decide what to do about a report.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return errors.New("The report id and an action are required.")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		body := reasonArg(args[2:])
+		body["action"] = args[1]
+		adminRequest(c.Post("/admin/reports/"+args[0]), body)
+	},
+}
+
+var AdminDenylistCmd = &cobra.Command{
+	Use:   "denylist",
+	Short: "List CIDs nobody can publish.",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, ok := adminRequest(c.Get("/admin/denylist"), nil)
+		if !ok {
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		gjson.ParseBytes(b).ForEach(func(_, value gjson.Result) bool {
+			fmt.Fprintln(tw, value.Get("cid").String()+"\t"+value.Get("reason").String())
+			return true
+		})
+		tw.Flush()
+	},
+}
+
+var AdminDenyCmd = &cobra.Command{
+	Use:   "deny [cid] [reason...]",
+	Short: "Stop everybody from publishing a CID.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest(c.Put("/admin/denylist/"+args[0]), reasonArg(args[1:]))
+	},
+}
+
+var AdminAllowCmd = &cobra.Command{
+	Use:   "allow [cid]",
+	Short: "Remove a CID from the denylist.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest(c.Delete("/admin/denylist/"+args[0]), nil)
+	},
+}
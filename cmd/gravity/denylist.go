@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+	"github.com/spf13/cobra"
+)
+
+var reason string
+
+// denylistEntry is the "badbits" double-hashed line for a cid, the same
+// the server reads from DENYLIST_FILE.
+func denylistEntry(cid string) (string, error) {
+	cid = strings.TrimPrefix(cid, "/ipfs/")
+	pcid, err := gocid.Parse(cid)
+	if err != nil {
+		return "", err
+	}
+	v1 := gocid.NewCidV1(pcid.Type(), pcid.Hash())
+	sum := sha256.Sum256([]byte(v1.String() + "/"))
+	return "//" + hex.EncodeToString(sum[:]), nil
+}
+
+var DenylistCmd = &cobra.Command{
+	Use:   "denylist",
+	Short: "Manage a denylist file in the IPFS badbits format, for server operators.",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// only local files are touched, no need for a server
+		return nil
+	},
+}
+
+var DenylistHashCmd = &cobra.Command{
+	Use:     "hash [cid...]",
+	Short:   "Print the double-hashed denylist entries for some CIDs.",
+	Example: `~> gravity denylist hash QmQjyLocqMrwxNnz5G1UtHZrRNsztgR97jLtch7bK28BWa`,
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, cid := range args {
+			entry, err := denylistEntry(cid)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid CID "+cid+": "+err.Error())
+				continue
+			}
+			fmt.Println(entry)
+		}
+	},
+}
+
+var DenylistAddCmd = &cobra.Command{
+	Use:     "add [file] [cid...]",
+	Short:   "Add CIDs to a denylist file, the server picks them up by itself.",
+	Example: `~> gravity denylist add /etc/gravity/badbits.deny bafybeihfg3d7rdltd43u3tfvncx7n5loqofbsobojcadtmokrljfthuc7y --reason "court order"`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return errors.New("The file and at least one CID are required.")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		entries := make([]string, 0, len(args)-1)
+		for _, cid := range args[1:] {
+			entry, err := denylistEntry(cid)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid CID "+cid+": "+err.Error())
+				return
+			}
+			entries = append(entries, entry)
+		}
+
+		f, err := os.OpenFile(args[0], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open "+args[0]+": "+err.Error())
+			return
+		}
+		defer f.Close()
+
+		comment := "# added " + time.Now().UTC().Format("2006-01-02")
+		if reason != "" {
+			comment += ": " + reason
+		}
+		_, err = fmt.Fprintln(f, comment+"\n"+strings.Join(entries, "\n"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write to "+args[0]+": "+err.Error())
+			return
+		}
+
+		fmt.Printf("Added %d entries to %s.\n", len(entries), args[0])
+	},
+}
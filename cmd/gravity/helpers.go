@@ -215,7 +215,7 @@ func updateKind(kind string) func(string, string, interface{}) {
 		}
 		if w.StatusCode >= 300 {
 			b, _ := ioutil.ReadAll(w.Body)
-			fmt.Fprintln(os.Stderr, string(b))
+			printError(w, b)
 			return
 		}
 	}
@@ -238,3 +238,35 @@ func getCID(key string) string {
 
 	return j.Get("cid").String()
 }
+
+// printError reports a failed request to the user, telling how long to
+// wait when the server is rate limiting us.
+func printError(w *http.Response, body []byte) {
+	if w.StatusCode == 429 {
+		wait := w.Header.Get("Retry-After")
+		if wait == "" {
+			wait = "a few"
+		}
+		fmt.Fprintf(os.Stderr,
+			"Too many requests to %s, try again in %s seconds.\n", server, wait)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, strings.TrimSpace(string(body)))
+}
+
+// checkServer makes sure --server points to a gravity instance.
+func checkServer() error {
+	req, _ := c.Get("/instance").Request()
+	w, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.New("Couldn't reach " + server + ": " + err.Error())
+	}
+	defer w.Body.Close()
+
+	b, _ := ioutil.ReadAll(w.Body)
+	if w.StatusCode >= 300 || gjson.GetBytes(b, "software").String() != "gravity" {
+		return errors.New(server + " doesn't look like a gravity server.")
+	}
+	return nil
+}
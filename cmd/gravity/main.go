@@ -28,6 +28,8 @@ var putNote string
 var quiet bool
 var showVersions bool
 var currentUser string
+var contact string
+var showAll bool
 
 func main() {
 	rootCmd.PersistentFlags().
@@ -53,6 +55,39 @@ func main() {
 	StarRmCmd.MarkFlagRequired("user")
 	StarListCmd.MarkFlagRequired("user")
 
+	FollowersCmd.PersistentFlags().
+		StringVarP(&currentUser, "user", "u", "", "Your username (required).")
+	FollowersCmd.Flags().Parse(os.Args[1:])
+
+	for _, cmd := range []*cobra.Command{FollowCmd, UnfollowCmd, TimelineCmd} {
+		cmd.Flags().
+			StringVarP(&currentUser, "user", "u", "", "Your username (required).")
+		cmd.Flags().Parse(os.Args[1:])
+		cmd.MarkFlagRequired("user")
+	}
+
+	ReportCmd.Flags().
+		StringVarP(&contact, "contact", "c", "", "How the admins can reach you, if they need to.")
+	ReportCmd.Flags().Parse(os.Args[1:])
+
+	AdminReportsCmd.Flags().
+		BoolVarP(&showAll, "all", "a", false, "Show resolved reports too.")
+	AdminReportsCmd.Flags().Parse(os.Args[1:])
+
+	DenylistAddCmd.Flags().
+		StringVarP(&reason, "reason", "r", "", "Why these are being added, written as a comment.")
+	DenylistAddCmd.Flags().Parse(os.Args[1:])
+
+	TransferAcceptCmd.Flags().
+		StringVarP(&currentUser, "user", "u", "", "Your username, the recipient (required).")
+	TransferAcceptCmd.Flags().Parse(os.Args[1:])
+	TransferAcceptCmd.MarkFlagRequired("user")
+
+	AdminCmd.PersistentFlags().
+		StringVarP(&currentUser, "user", "u", "", "Your username, one of the server's ADMINS (required).")
+	AdminCmd.Flags().Parse(os.Args[1:])
+	AdminCmd.MarkPersistentFlagRequired("user")
+
 	baseURL := server
 	if !strings.HasPrefix(server, "http") {
 		baseURL = "https://" + server
@@ -62,11 +97,25 @@ func main() {
 		Set("Accept", "application/json")
 
 	rootCmd.AddCommand(RegisterCmd, RecoverAccountCmd)
-	rootCmd.AddCommand(PutCmd, RenameCmd, NoteCmd, BodyCmd)
+	rootCmd.AddCommand(PutCmd, RenameCmd, NoteCmd, BodyCmd, PinCmd, UnpinCmd, TagCmd)
+	rootCmd.AddCommand(AliasCmd)
+	AliasCmd.AddCommand(AliasAddCmd, AliasRmCmd)
+	rootCmd.AddCommand(TransferCmd)
+	TransferCmd.AddCommand(TransferAcceptCmd, TransferCancelCmd)
 	rootCmd.AddCommand(GetCmd, StatCmd)
-	rootCmd.AddCommand(DelCmd)
+	rootCmd.AddCommand(DelCmd, ReportCmd)
 	rootCmd.AddCommand(StarCmd)
 	StarCmd.AddCommand(StarAddCmd, StarRmCmd, StarListCmd)
+	rootCmd.AddCommand(FollowersCmd)
+	FollowersCmd.AddCommand(FollowersListCmd, FollowersApproveCmd, FollowersRejectCmd,
+		FollowersBlockCmd, FollowersUnblockCmd, FollowersApprovalCmd)
+	rootCmd.AddCommand(FollowCmd, UnfollowCmd, TimelineCmd)
+	rootCmd.AddCommand(AdminCmd, DenylistCmd)
+	DenylistCmd.AddCommand(DenylistHashCmd, DenylistAddCmd)
+	AdminCmd.AddCommand(AdminUsersCmd, AdminSuspendCmd, AdminUnsuspendCmd, AdminDelUserCmd,
+		AdminHideCmd, AdminTakedownCmd, AdminRestoreCmd, AdminLogCmd,
+		AdminBlocksCmd, AdminBlockCmd, AdminUnblockCmd, AdminDeliveriesCmd,
+		AdminReportsCmd, AdminResolveCmd, AdminDenylistCmd, AdminDenyCmd, AdminAllowCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -84,6 +133,9 @@ gravity is a centralized index for all files distributed over IPFS.
 You can use gravity as a hub to which you can announce data you've made available through IPFS or in which you'll find interesting stuff from others to pin.
     `,
 	Version: "v2",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return checkServer()
+	},
 }
 
 var RegisterCmd = &cobra.Command{
@@ -123,9 +175,12 @@ var RegisterCmd = &cobra.Command{
 		}
 		if w.StatusCode >= 300 {
 			b, _ := ioutil.ReadAll(w.Body)
-			fmt.Fprint(os.Stderr, string(b))
+			printError(w, b)
 			return
 		}
+
+		fmt.Println("Registered " + username + ". Check " + email +
+			" for a link to confirm your address. You can publish records for a while, but after that you'll have to confirm it to keep publishing.")
 	},
 }
 
@@ -219,6 +274,10 @@ zdj7WbCpyr2qx765pmd5TbeiRmrQdQbnWQPVK6LuGPUfCGksM 53582473  002/
 			// it's just one record
 			parts := strings.Split(args[0], "/")
 
+			if moved := j.Get("moved_to").String(); moved != "" {
+				fmt.Fprintln(os.Stderr, parts[0]+"/"+parts[1]+" was renamed to "+moved+".")
+			}
+
 			if len(parts) > 2 {
 				// command was called with more than two strings in the path,
 				// so we'll call `ipfs ls` on the result
@@ -334,7 +393,7 @@ var PutCmd = &cobra.Command{
 		}
 		if w.StatusCode >= 300 {
 			b, _ := ioutil.ReadAll(w.Body)
-			fmt.Fprint(os.Stderr, string(b))
+			printError(w, b)
 			return
 		}
 	},
@@ -349,6 +408,102 @@ var RenameCmd = &cobra.Command{
 	},
 }
 
+var AliasCmd = &cobra.Command{
+	Use:   "alias",
+	Short: "Give a record extra names, they work like the old names left by renames.",
+}
+
+var AliasAddCmd = &cobra.Command{
+	Use:     "add [key] [alias]",
+	Short:   "Make a record also reachable as owner/alias.",
+	Example: `~> gravity alias add fiatjaf/gravity gravity-cli`,
+	Args:    aliasArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		setAlias(args[0], args[1], false)
+	},
+}
+
+var AliasRmCmd = &cobra.Command{
+	Use:   "rm [key] [alias]",
+	Short: "Remove an alias or an old name from a record.",
+	Args:  aliasArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		setAlias(args[0], args[1], true)
+	},
+}
+
+func aliasArgs(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return errors.New("2 arguments are required, the record and the alias.")
+	}
+	return validateArgKey(cmd, args)
+}
+
+func setAlias(key, alias string, remove bool) {
+	sk, err := getPrivateKey()
+	if err != nil {
+		return
+	}
+
+	parts := strings.Split(key, "/")
+	owner := parts[0]
+	name := parts[1]
+
+	token, err := makeJWT(sk, jwt.MapClaims{
+		"owner": owner,
+		"name":  name,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to make JWT: "+err.Error())
+		return
+	}
+
+	path := "/" + owner + "/" + name + "/aliases/" + alias
+	s := c.Put(path)
+	if remove {
+		s = c.Delete(path)
+	}
+	req, _ := s.Set("Token", token).Request()
+	w, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Request failed: "+err.Error())
+		return
+	}
+	if w.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(w.Body)
+		printError(w, b)
+		return
+	}
+}
+
+var PinCmd = &cobra.Command{
+	Use:   "pin [key]",
+	Short: "Feature a record on your profile.",
+	Args:  validateArgKey,
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(RECORD)(args[0], "pinned", true)
+	},
+}
+
+var UnpinCmd = &cobra.Command{
+	Use:   "unpin [key]",
+	Short: "Stop featuring a record on your profile.",
+	Args:  validateArgKey,
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(RECORD)(args[0], "pinned", false)
+	},
+}
+
+var TagCmd = &cobra.Command{
+	Use:     "tag [key] [tags...]",
+	Short:   "Set the tags of a record. Call it without tags to remove all.",
+	Example: "~> gravity tag fiatjaf/music jazz bossa-nova",
+	Args:    validateArgKey,
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(RECORD)(args[0], "tags", args[1:])
+	},
+}
+
 var NoteCmd = &cobra.Command{
 	Use:   "note [key] [note]",
 	Short: "Set a note for the record given by [key].",
@@ -437,9 +592,43 @@ var DelCmd = &cobra.Command{
 		}
 		if w.StatusCode >= 300 {
 			b, _ := ioutil.ReadAll(w.Body)
-			fmt.Fprint(os.Stderr, string(b))
+			printError(w, b)
+			return
+		}
+	},
+}
+
+var ReportCmd = &cobra.Command{
+	Use:   "report [key] [category] [description...]",
+	Short: "Tell the server admins about an illegal or abusive record.",
+	Long: `Tell the server admins about an illegal or abusive record.
+
+The category must be one of illegal, copyright, abuse, spam or other.`,
+	Example: `~> gravity report someone/something copyright this is my book, I never published it`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return errors.New("The record and a category are required.")
+		}
+		return validateArgKey(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		req, _ := c.Post("/" + args[0] + "/report").BodyJSON(map[string]interface{}{
+			"category":    args[1],
+			"description": strings.Join(args[2:], " "),
+			"contact":     contact,
+		}).Request()
+		w, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Request failed: "+err.Error())
+			return
+		}
+		if w.StatusCode >= 300 {
+			b, _ := ioutil.ReadAll(w.Body)
+			printError(w, b)
 			return
 		}
+
+		fmt.Println("Reported " + args[0] + ", thank you.")
 	},
 }
 
@@ -492,6 +681,176 @@ var StarListCmd = &cobra.Command{
 	},
 }
 
+var FollowersCmd = &cobra.Command{
+	Use:              "followers",
+	Short:            "Manage who follows you on the fediverse.",
+	TraverseChildren: true,
+}
+
+var FollowersListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List your followers, pending follow requests and blocks.",
+	Example: `~> gravity followers ls -u fiatjaf
+https://mastodon.social/users/someone      accepted
+https://pleroma.site/users/someone-else    pending
+spam.example.com                           blocked
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		sk, err := getPrivateKey()
+		if err != nil {
+			return
+		}
+
+		token, err := makeJWT(sk, jwt.MapClaims{"owner": currentUser})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to make JWT: "+err.Error())
+			return
+		}
+
+		req, _ := c.Get("/pub/user/"+currentUser+"/relationships").
+			Set("Token", token).Request()
+		w, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Request failed: "+err.Error())
+			return
+		}
+		b, _ := ioutil.ReadAll(w.Body)
+		if w.StatusCode >= 300 {
+			printError(w, b)
+			return
+		}
+
+		j := gjson.ParseBytes(b)
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		j.Get("followers").ForEach(func(_, value gjson.Result) bool {
+			status := "accepted"
+			if value.Get("pending").Bool() {
+				status = "pending"
+			}
+			fmt.Fprintln(tw, value.Get("actor").String()+"\t"+status)
+			return true
+		})
+		j.Get("blocks").ForEach(func(_, value gjson.Result) bool {
+			fmt.Fprintln(tw, value.String()+"\tblocked")
+			return true
+		})
+		tw.Flush()
+	},
+}
+
+var FollowersApproveCmd = &cobra.Command{
+	Use:     "approve [actor]",
+	Aliases: []string{"accept"},
+	Short:   "Approve a pending follow request.",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(USER)(currentUser, "approve", args[0])
+	},
+}
+
+var FollowersRejectCmd = &cobra.Command{
+	Use:     "reject [actor]",
+	Aliases: []string{"rm", "remove"},
+	Short:   "Reject a follow request or remove an existing follower.",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(USER)(currentUser, "reject", args[0])
+	},
+}
+
+var FollowersBlockCmd = &cobra.Command{
+	Use:   "block [actor or domain]",
+	Short: "Block an actor or an entire domain from following or interacting with you.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(USER)(currentUser, "block", args[0])
+	},
+}
+
+var FollowersUnblockCmd = &cobra.Command{
+	Use:   "unblock [actor or domain]",
+	Short: "Remove a block.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(USER)(currentUser, "unblock", args[0])
+	},
+}
+
+var FollowersApprovalCmd = &cobra.Command{
+	Use:   "approval [on|off]",
+	Short: "Turn on or off manual approval of new followers.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return errors.New("Argument must be either 'on' or 'off'.")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(USER)(currentUser, "manually_approves_followers", args[0] == "on")
+	},
+}
+
+var FollowCmd = &cobra.Command{
+	Use:   "follow [actor]",
+	Short: "Follow someone on the fediverse or on another gravity instance.",
+	Long: `Follow someone on the fediverse or on another gravity instance.
+
+The actor can be given as an URL or as user@domain. IPFS hashes they post will show up in your timeline.
+    `,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(USER)(currentUser, "follow", args[0])
+	},
+}
+
+var UnfollowCmd = &cobra.Command{
+	Use:   "unfollow [actor]",
+	Short: "Stop following someone.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateKind(USER)(currentUser, "unfollow", args[0])
+	},
+}
+
+var TimelineCmd = &cobra.Command{
+	Use:   "timeline",
+	Short: "List IPFS hashes posted by the people you follow.",
+	Run: func(cmd *cobra.Command, args []string) {
+		sk, err := getPrivateKey()
+		if err != nil {
+			return
+		}
+
+		token, err := makeJWT(sk, jwt.MapClaims{"owner": currentUser})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to make JWT: "+err.Error())
+			return
+		}
+
+		req, _ := c.Get("/"+currentUser+"/timeline").Set("Token", token).Request()
+		w, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Request failed: "+err.Error())
+			return
+		}
+		b, _ := ioutil.ReadAll(w.Body)
+		if w.StatusCode >= 300 {
+			printError(w, b)
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+		gjson.ParseBytes(b).ForEach(func(_, value gjson.Result) bool {
+			fmt.Fprintln(tw, value.Get("cid").String()+"	"+
+				value.Get("actor").String()+"	"+
+				value.Get("url").String())
+			return true
+		})
+		tw.Flush()
+	},
+}
+
 var RecoverAccountCmd = &cobra.Command{
 	Use:   "recoveraccount",
 	Short: "Recover your account after losing your private key.",
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dghubble/sling"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/cobra"
+)
+
+var TransferCmd = &cobra.Command{
+	Use:   "transfer [key] [recipient]",
+	Short: "Give a record to another user, it moves once they accept it.",
+	Long: `Give a record to another user, it moves once they accept it.
+
+Its history and stars go along and the old key keeps working as an alias to
+the new one. Until the recipient accepts it you can still cancel the transfer.`,
+	Example: `~> gravity transfer fiatjaf/gravity someone`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("2 arguments are required, the record and the recipient.")
+		}
+		return validateArgKey(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		parts := strings.Split(args[0], "/")
+		owner := parts[0]
+		name := parts[1]
+
+		ok := transferRequest(c.Post("/"+owner+"/"+name+"/transfer").
+			BodyJSON(map[string]interface{}{"to": args[1]}), jwt.MapClaims{
+			"owner": owner,
+			"name":  name,
+		})
+		if !ok {
+			return
+		}
+
+		fmt.Printf("%s was offered to %s, they have to run `gravity transfer accept %s`.\n",
+			args[0], args[1], args[0])
+	},
+}
+
+var TransferAcceptCmd = &cobra.Command{
+	Use:     "accept [key]",
+	Short:   "Accept a record someone is transferring to you.",
+	Example: `~> gravity transfer accept fiatjaf/gravity -u someone`,
+	Args:    validateArgKey,
+	Run: func(cmd *cobra.Command, args []string) {
+		ok := transferRequest(c.Post("/"+args[0]+"/transfer/accept"), jwt.MapClaims{
+			"owner":    currentUser,
+			"transfer": args[0],
+		})
+		if !ok {
+			return
+		}
+
+		name := strings.Split(args[0], "/")[1]
+		fmt.Println("The record is now at " + currentUser + "/" + name + ".")
+	},
+}
+
+var TransferCancelCmd = &cobra.Command{
+	Use:   "cancel [key]",
+	Short: "Cancel a transfer the recipient hasn't accepted yet.",
+	Args:  validateArgKey,
+	Run: func(cmd *cobra.Command, args []string) {
+		parts := strings.Split(args[0], "/")
+		transferRequest(c.Delete("/"+args[0]+"/transfer"), jwt.MapClaims{
+			"owner": parts[0],
+			"name":  parts[1],
+		})
+	},
+}
+
+// transferRequest signs claims with the local key and sends the request,
+// printing the error if there is one.
+func transferRequest(r *sling.Sling, claims jwt.MapClaims) bool {
+	sk, err := getPrivateKey()
+	if err != nil {
+		return false
+	}
+
+	token, err := makeJWT(sk, claims)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to make JWT: "+err.Error())
+		return false
+	}
+
+	req, _ := r.Set("Token", token).Request()
+	w, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Request failed: "+err.Error())
+		return false
+	}
+	if w.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(w.Body)
+		printError(w, b)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/gorilla/mux"
+)
+
+const pubPageSize = 20
+
+type PubCollection struct {
+	litepub.Base
+	TotalItems int         `json:"totalItems"`
+	First      interface{} `json:"first,omitempty"`
+	Last       string      `json:"last,omitempty"`
+}
+
+type PubCollectionPage struct {
+	litepub.Base
+	PartOf       string      `json:"partOf"`
+	TotalItems   int         `json:"totalItems"`
+	Next         string      `json:"next,omitempty"`
+	Prev         string      `json:"prev,omitempty"`
+	OrderedItems interface{} `json:"orderedItems"`
+}
+
+// pubServeCollection serves an OrderedCollection with its first page
+// embedded or, when ?page=n is given, just that page. fetch gets the items
+// of a page.
+func pubServeCollection(
+	w http.ResponseWriter,
+	r *http.Request,
+	id string,
+	total int,
+	fetch func(limit, offset int) (interface{}, error),
+) {
+	n := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		n, _ = strconv.Atoi(p)
+		if n < 1 {
+			http.Error(w, "Invalid page.", 400)
+			return
+		}
+	}
+	last := (total + pubPageSize - 1) / pubPageSize
+	if last < 1 {
+		last = 1
+	}
+
+	items, err := fetch(pubPageSize, (n-1)*pubPageSize)
+	if err != nil {
+		log.Warn().Err(err).Str("collection", id).Msg("error fetching collection items")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	page := PubCollectionPage{
+		Base: litepub.Base{
+			Type: "OrderedCollectionPage",
+			Id:   fmt.Sprintf("%s?page=%d", id, n),
+		},
+		PartOf:       id,
+		TotalItems:   total,
+		OrderedItems: items,
+	}
+	if n < last {
+		page.Next = fmt.Sprintf("%s?page=%d", id, n+1)
+	}
+	if n > 1 {
+		page.Prev = fmt.Sprintf("%s?page=%d", id, n-1)
+	}
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	if r.URL.Query().Get("page") != "" {
+		page.Base.Context = litepub.CONTEXT
+		json.NewEncoder(w).Encode(page)
+	} else {
+		json.NewEncoder(w).Encode(PubCollection{
+			Base: litepub.Base{
+				Context: litepub.CONTEXT,
+				Type:    "OrderedCollection",
+				Id:      id,
+			},
+			TotalItems: total,
+			First:      page,
+			Last:       fmt.Sprintf("%s?page=%d", id, last),
+		})
+	}
+}
+
+func (s *Server) pubUserFollowing(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+
+	var total int
+	err := s.pg.GetContext(r.Context(), &total, `
+        SELECT count(*) FROM pub_following
+        WHERE owner = $1 AND accepted
+    `, owner)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error counting following")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	pubServeCollection(w, r, s.ServiceURL+"/pub/user/"+owner+"/following", total,
+		func(limit, offset int) (interface{}, error) {
+			following := make([]string, 0)
+			err := s.pg.SelectContext(r.Context(), &following, `
+                SELECT actor FROM pub_following
+                WHERE owner = $1 AND accepted
+                ORDER BY created_at DESC
+                LIMIT $2 OFFSET $3
+            `, owner, limit, offset)
+			return following, err
+		})
+}
+
+// pubUserFeatured lists the records owner has pinned, as notes for their
+// latest versions.
+func (s *Server) pubUserFeatured(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+
+	var total int
+	err := s.pg.GetContext(r.Context(), &total, `
+        SELECT count(*) FROM head
+        WHERE owner = $1 AND pinned AND state = 'visible'
+    `, owner)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error counting pinned records")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	pubServeCollection(w, r, s.ServiceURL+"/pub/user/"+owner+"/featured", total,
+		func(limit, offset int) (interface{}, error) {
+			var dbnotes []DBNote
+			err := s.pg.SelectContext(r.Context(), &dbnotes, `
+                SELECT
+                  history.id::text AS id,
+                  owner,
+                  name,
+                  history.set_at,
+                  history.cid,
+                  note,
+                  body,
+                  tags,
+                  media_type,
+                  author
+                FROM head
+                INNER JOIN history ON history.id = (
+                  SELECT max(id) FROM history WHERE record_id = head.id
+                )
+                WHERE owner = $1 AND pinned AND state = 'visible'
+                ORDER BY name
+                LIMIT $2 OFFSET $3
+            `, owner, limit, offset)
+
+			dbnotes = s.visibleNotes(dbnotes)
+			notes := make([]PubNote, len(dbnotes))
+			for i, dbnote := range dbnotes {
+				notes[i] = s.makeNote(dbnote)
+			}
+			return notes, err
+		})
+}
+
+// pubUserLiked lists the notes for the records owner has starred.
+func (s *Server) pubUserLiked(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+
+	var total int
+	err := s.pg.GetContext(r.Context(), &total, `
+        SELECT count(*)
+        FROM stars
+        INNER JOIN head
+          ON head.owner = target_owner AND head.name = target_name
+        WHERE source = $1 AND state = 'visible'
+    `, owner)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error counting stars")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	pubServeCollection(w, r, s.ServiceURL+"/pub/user/"+owner+"/liked", total,
+		func(limit, offset int) (interface{}, error) {
+			var ids []string
+			err := s.pg.SelectContext(r.Context(), &ids, `
+                SELECT (
+                  SELECT max(id) FROM history WHERE record_id = head.id
+                )::text
+                FROM stars
+                INNER JOIN head
+                  ON head.owner = target_owner AND head.name = target_name
+                WHERE source = $1 AND state = 'visible'
+                ORDER BY starred_at DESC
+                LIMIT $2 OFFSET $3
+            `, owner, limit, offset)
+
+			liked := make([]string, len(ids))
+			for i, id := range ids {
+				liked[i] = s.ServiceURL + "/pub/note/" + id
+			}
+			return liked, err
+		})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Delivery struct {
+	Id            int    `json:"id" db:"id"`
+	ActivityId    string `json:"activity_id" db:"activity_id"`
+	Sender        string `json:"sender" db:"sender"`
+	Inbox         string `json:"inbox" db:"inbox"`
+	Unresolved    bool   `json:"unresolved,omitempty" db:"unresolved"` // inbox is an actor
+	Body          string `json:"-" db:"body"`
+	Attempts      int    `json:"attempts" db:"attempts"`
+	NextAttemptAt string `json:"next_attempt_at" db:"next_attempt_at"`
+	LastError     string `json:"last_error,omitempty" db:"last_error"`
+	Dead          bool   `json:"dead" db:"dead"`
+	CreatedAt     string `json:"created_at" db:"created_at"`
+}
+
+type DeliveryQueueStatus struct {
+	Pending  int        `json:"pending" db:"pending"`
+	Retrying int        `json:"retrying" db:"retrying"`
+	Dead     int        `json:"dead" db:"dead"`
+	Items    []Delivery `json:"items"`
+}
+
+const deliveryBatchSize = 100
+
+// pubEnqueue stores one delivery of the given activity for each distinct
+// inbox among the followers of owner. followers that share an inbox are
+// delivered to only once. followers from before we started storing inboxes
+// get a delivery to themselves, the worker finds their inboxes later.
+func (s *Server) pubEnqueue(owner, activityId string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pg.Exec(`
+        INSERT INTO pub_deliveries (activity_id, sender, inbox, unresolved, body)
+        SELECT DISTINCT
+          $2, $1, coalesce(nullif(shared_inbox, ''), nullif(inbox, ''), follower),
+          inbox = '', $3
+        FROM pub_user_followers
+        WHERE target = $1 AND NOT pending
+        ON CONFLICT (activity_id, inbox) DO NOTHING
+    `, owner, activityId, string(body))
+	if err != nil {
+		return err
+	}
+
+	s.wakeDeliveryWorker()
+
+	return nil
+}
+
+// pubEnqueueFollowers is pubEnqueue for followers that are not stored
+// anymore, like those of a deleted user.
+func (s *Server) pubEnqueueFollowers(sender, activityId string, activity interface{}, followers []Follower) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	for _, follower := range followers {
+		inbox, unresolved := follower.SharedInbox, false
+		if inbox == "" {
+			inbox = follower.Inbox
+		}
+		if inbox == "" {
+			inbox, unresolved = follower.Actor, true
+		}
+
+		_, err = s.pg.Exec(`
+            INSERT INTO pub_deliveries (activity_id, sender, inbox, unresolved, body)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (activity_id, inbox) DO NOTHING
+        `, activityId, sender, inbox, unresolved, string(body))
+		if err != nil {
+			return err
+		}
+	}
+
+	s.wakeDeliveryWorker()
+	return nil
+}
+
+// pubEnqueueInbox stores a delivery of the given activity to a single inbox.
+func (s *Server) pubEnqueueInbox(sender, inbox, activityId string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pg.Exec(`
+        INSERT INTO pub_deliveries (activity_id, sender, inbox, body)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (activity_id, inbox) DO NOTHING
+    `, activityId, sender, inbox, string(body))
+	if err != nil {
+		return err
+	}
+
+	s.wakeDeliveryWorker()
+	return nil
+}
+
+func (s *Server) wakeDeliveryWorker() {
+	select {
+	case s.deliveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// pubDeliveryWorker sends queued deliveries until ctx is done, then sends
+// one last round of whatever is due before returning. requests are made
+// with sendCtx, so they can be interrupted while that last round goes on.
+func (s *Server) pubDeliveryWorker(ctx, sendCtx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		for s.pubDeliverBatch(sendCtx) == deliveryBatchSize {
+			// there's probably more waiting, keep going
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.deliveryWake:
+		case <-ctx.Done():
+			for sendCtx.Err() == nil && s.pubDeliverBatch(sendCtx) == deliveryBatchSize {
+				// drain what was queued by the last requests
+			}
+			return
+		}
+	}
+}
+
+// pubDeliverBatch takes a batch of due deliveries out of the queue and
+// sends them, at most s.PubDeliveryConcurrency inboxes at a time and
+// one request at a time for each inbox. returns how many were taken.
+func (s *Server) pubDeliverBatch(ctx context.Context) int {
+	// claimed deliveries are pushed forward so that if we die while
+	// sending them they will be retried later instead of lost.
+	var deliveries []Delivery
+	err := s.pg.Select(&deliveries, `
+        UPDATE pub_deliveries SET next_attempt_at = now() + interval '10 minutes'
+        WHERE id IN (
+          SELECT id FROM pub_deliveries
+          WHERE NOT dead AND next_attempt_at <= now()
+          ORDER BY next_attempt_at
+          LIMIT $1
+          FOR UPDATE SKIP LOCKED
+        )
+        RETURNING
+          id, activity_id, sender, inbox, unresolved, body, attempts,
+          next_attempt_at, last_error, dead, created_at
+    `, deliveryBatchSize)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch pending deliveries")
+		return 0
+	}
+
+	// unresolved deliveries have an actor in place of the inbox
+	byInbox := make(map[string][]Delivery)
+	for _, d := range deliveries {
+		byInbox[d.Inbox] = append(byInbox[d.Inbox], d)
+	}
+
+	sem := make(chan struct{}, s.PubDeliveryConcurrency)
+	var wg sync.WaitGroup
+	for _, inboxDeliveries := range byInbox {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(inboxDeliveries []Delivery) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			for _, d := range inboxDeliveries {
+				if d.Unresolved {
+					s.pubResolveDelivery(d)
+				} else {
+					s.pubDeliver(ctx, d)
+				}
+			}
+		}(inboxDeliveries)
+	}
+	wg.Wait()
+
+	return len(deliveries)
+}
+
+// pubResolveDelivery finds the inbox of the follower in d.Inbox and
+// replaces d with a delivery to it, which is sent in a following batch.
+// followers that share that inbox with others already have it queued.
+func (s *Server) pubResolveDelivery(d Delivery) {
+	follower := d.Inbox
+	inbox, sharedInbox, err := fetchActorInboxes(follower)
+	if err != nil {
+		ferr, ok := err.(fetchError)
+		s.pubDeliveryFailed(d, err, ok && permanentFailure(ferr.status))
+		return
+	}
+
+	_, err = s.pg.Exec(`
+        UPDATE pub_user_followers SET inbox = $2, shared_inbox = $3
+        WHERE follower = $1
+    `, follower, inbox, sharedInbox)
+	if err != nil {
+		log.Warn().Err(err).Str("follower", follower).Msg("failed to store inboxes")
+	}
+
+	if sharedInbox != "" {
+		inbox = sharedInbox
+	}
+	_, err = s.pg.Exec(`
+        WITH resolved AS (
+          DELETE FROM pub_deliveries WHERE id = $1
+          RETURNING activity_id, sender, body
+        )
+        INSERT INTO pub_deliveries (activity_id, sender, inbox, body)
+        SELECT activity_id, sender, $2, body FROM resolved
+        ON CONFLICT (activity_id, inbox) DO NOTHING
+    `, d.Id, inbox)
+	if err != nil {
+		log.Warn().Err(err).Int("id", d.Id).Msg("failed to update delivery")
+		return
+	}
+
+	s.wakeDeliveryWorker()
+}
+
+func (s *Server) pubDeliver(ctx context.Context, d Delivery) {
+	permanent := false
+	resp, err := s.pubSendAs(ctx, d.Sender, d.Inbox, json.RawMessage(d.Body))
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err == nil && resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("%s: %s", resp.Status, string(b))
+		permanent = permanentFailure(resp.StatusCode)
+	}
+
+	if err == nil {
+		s.metrics.deliveries.WithLabelValues("delivered").Inc()
+		_, err = s.pg.Exec(`DELETE FROM pub_deliveries WHERE id = $1`, d.Id)
+		if err != nil {
+			log.Warn().Err(err).Int("id", d.Id).Msg("failed to remove delivery")
+		}
+		return
+	}
+
+	if ctx.Err() != nil {
+		// we're shutting down, it was claimed so it will be retried later
+		return
+	}
+	s.pubDeliveryFailed(d, err, permanent)
+}
+
+// permanentFailure is when the remote server doesn't want what we're
+// sending, there's no point in retrying.
+func permanentFailure(status int) bool {
+	return status >= 400 && status < 500 && status != 408 && status != 429
+}
+
+// pubDeliveryFailed schedules d to be retried later, or gives up on it.
+func (s *Server) pubDeliveryFailed(d Delivery, err error, permanent bool) {
+	attempts := d.Attempts + 1
+	if permanent || attempts >= s.PubDeliveryMaxAttempts {
+		log.Warn().Err(err).Str("inbox", d.Inbox).Str("activity", d.ActivityId).
+			Int("attempts", attempts).Msg("giving up on delivery")
+		s.metrics.deliveries.WithLabelValues("dead").Inc()
+		_, err = s.pg.Exec(`
+            UPDATE pub_deliveries
+            SET dead = true, attempts = $2, last_error = $3
+            WHERE id = $1
+        `, d.Id, attempts, err.Error())
+	} else {
+		log.Info().Err(err).Str("inbox", d.Inbox).Str("activity", d.ActivityId).
+			Int("attempts", attempts).Msg("delivery failed, will retry")
+		s.metrics.deliveries.WithLabelValues("retry").Inc()
+		_, err = s.pg.Exec(`
+            UPDATE pub_deliveries
+            SET attempts = $2, last_error = $3,
+                next_attempt_at = now() + $4 * interval '1 second'
+            WHERE id = $1
+        `, d.Id, attempts, err.Error(), deliveryBackoff(attempts).Seconds())
+	}
+	if err != nil {
+		log.Warn().Err(err).Int("id", d.Id).Msg("failed to update delivery")
+	}
+}
+
+// deliveryBackoff is 30s after the first failure, doubling on each
+// following failure up to 12h.
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= 12*time.Hour {
+			return 12 * time.Hour
+		}
+	}
+	return backoff
+}
+
+func (s *Server) pubDeliveriesStatus(w http.ResponseWriter, r *http.Request, admin string) {
+	var status DeliveryQueueStatus
+	err := s.pg.GetContext(r.Context(), &status, `
+        SELECT
+          count(*) FILTER (WHERE NOT dead AND attempts = 0) AS pending,
+          count(*) FILTER (WHERE NOT dead AND attempts > 0) AS retrying,
+          count(*) FILTER (WHERE dead) AS dead
+        FROM pub_deliveries
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("error fetching delivery queue status")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	status.Items = make([]Delivery, 0)
+	err = s.pg.SelectContext(r.Context(), &status.Items, `
+        SELECT
+          id, activity_id, sender, inbox, unresolved, body, attempts,
+          next_attempt_at, last_error, dead, created_at
+        FROM pub_deliveries
+        WHERE attempts > 0
+        ORDER BY dead, next_attempt_at
+        LIMIT 100
+    `)
+	if err != nil && err != sql.ErrNoRows {
+		log.Warn().Err(err).Msg("error fetching failed deliveries")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) pubDeliveryRetry(w http.ResponseWriter, r *http.Request, admin string) {
+	id := mux.Vars(r)["id"]
+
+	res, err := s.pg.ExecContext(r.Context(), `
+        UPDATE pub_deliveries
+        SET dead = false, attempts = 0, next_attempt_at = now()
+        WHERE id = $1
+    `, id)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("error requeueing delivery")
+		http.Error(w, "Error requeueing delivery.", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Delivery not found.", 404)
+		return
+	}
+
+	s.wakeDeliveryWorker()
+
+	s.audit(r.Context(), admin, "retry_delivery", id, "")
+	w.WriteHeader(200)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gocid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// Denylist is a list of CIDs in the "badbits" double-hash format, read from
+// a local file, so the list can be shared without saying what is in it. it
+// is reloaded when the file changes.
+//
+// the file can be in the compact format, one entry per line, with an
+// optional header ending in "---":
+//
+//	//d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7
+//	//QmVTF1yEejXd9iMgoRTFDxBv7HAz9kuZcQNBzHrceuK9HR
+//	/ipfs/bafybeihfg3d7rdltd43u3tfvncx7n5loqofbsobojcadtmokrljfthuc7y
+//
+// or the older json list of {"anchor": "<hex sha256>"} objects.
+//
+// hex entries are legacy badbits anchors, the sha256 of "<base32 cidv1>/".
+// multihash entries are the sha256 of the cid's base58 multihash, which
+// doesn't depend on the cid version.
+type Denylist struct {
+	Path string
+
+	mu      sync.RWMutex
+	entries denylistEntries
+	modTime time.Time
+}
+
+type denylistEntries struct {
+	anchors map[string]bool // hex, legacy
+	blocks  map[string]bool // hex digest of the multihash entries
+}
+
+// denylistHashes are both double hashes of a cid as used in badbits entries.
+func denylistHashes(cid string) (anchor, block string, err error) {
+	pcid, err := gocid.Parse(cid)
+	if err != nil {
+		return "", "", err
+	}
+	v1 := gocid.NewCidV1(pcid.Type(), pcid.Hash())
+	asum := sha256.Sum256([]byte(v1.String() + "/"))
+	bsum := sha256.Sum256([]byte(pcid.Hash().B58String()))
+	return hex.EncodeToString(asum[:]), hex.EncodeToString(bsum[:]), nil
+}
+
+// Contains tells if cid is in the list. a nil list contains nothing.
+func (d *Denylist) Contains(cid string) bool {
+	if d == nil {
+		return false
+	}
+	anchor, block, err := denylistHashes(cid)
+	if err != nil {
+		return false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.entries.anchors[anchor] || d.entries.blocks[block]
+}
+
+// visibleNotes leaves out the notes whose cid is in the denylist.
+func (s *Server) visibleNotes(dbnotes []DBNote) []DBNote {
+	visible := make([]DBNote, 0, len(dbnotes))
+	for _, dbnote := range dbnotes {
+		if !s.denylist.Contains(dbnote.CID) {
+			visible = append(visible, dbnote)
+		}
+	}
+	return visible
+}
+
+func (d *Denylist) Len() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.entries.anchors) + len(d.entries.blocks)
+}
+
+// Reload reads the file again if it changed since the last time.
+func (d *Denylist) Reload() (changed bool, err error) {
+	info, err := os.Stat(d.Path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(d.modTime) {
+		return false, nil
+	}
+
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	entries, err := parseDenylist(f)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	d.entries = entries
+	d.modTime = info.ModTime()
+	d.mu.Unlock()
+	return true, nil
+}
+
+func parseDenylist(r io.Reader) (entries denylistEntries, err error) {
+	entries.anchors = make(map[string]bool)
+	entries.blocks = make(map[string]bool)
+
+	br := bufio.NewReader(r)
+	if first, err := br.Peek(1); err == nil && first[0] == '[' {
+		var anchors []struct {
+			Anchor string `json:"anchor"`
+		}
+		if err := json.NewDecoder(br).Decode(&anchors); err != nil {
+			return entries, err
+		}
+		for _, a := range anchors {
+			entries.anchors[strings.ToLower(a.Anchor)] = true
+		}
+		return entries, nil
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "---" {
+			// everything before this was the header
+			lines = lines[:0]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, err
+	}
+
+	for _, line := range lines {
+		entries.add(line)
+	}
+	return entries, nil
+}
+
+// add reads one line of the compact format. lines that aren't cid entries,
+// like comments, paths inside cids and allow rules, are ignored.
+func (e denylistEntries) add(line string) {
+	// hints after the entry are separated by a space
+	if i := strings.IndexAny(line, " \t"); i != -1 {
+		line = line[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(line, "//"):
+		entry := line[2:]
+		if len(entry) == 64 {
+			if _, err := hex.DecodeString(entry); err == nil {
+				e.anchors[strings.ToLower(entry)] = true
+				return
+			}
+		}
+		decoded, err := mh.FromB58String(entry)
+		if err != nil {
+			return
+		}
+		dmh, err := mh.Decode(decoded)
+		if err != nil || dmh.Code != mh.SHA2_256 {
+			return
+		}
+		e.blocks[hex.EncodeToString(dmh.Digest)] = true
+	case strings.HasPrefix(line, "/ipfs/"):
+		cid := strings.TrimPrefix(line, "/ipfs/")
+		if strings.Contains(cid, "/") {
+			return
+		}
+		if _, block, err := denylistHashes(cid); err == nil {
+			e.blocks[block] = true
+		}
+	}
+}
+
+// denylistWorker checks the denylist file for changes.
+func (s *Server) denylistWorker(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(s.DenylistReloadInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		if changed, err := s.denylist.Reload(); err != nil {
+			log.Warn().Err(err).Str("path", s.denylist.Path).Msg("failed to reload denylist")
+		} else if changed {
+			log.Info().Int("entries", s.denylist.Len()).Msg("denylist reloaded")
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestVisibleNotes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist")
+	if err := ioutil.WriteFile(path, []byte("/ipfs/"+testCID2+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{denylist: &Denylist{Path: path}}
+	if _, err := s.denylist.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	visible := s.visibleNotes([]DBNote{{Id: "1", CID: testCID1}, {Id: "2", CID: testCID2}})
+	if len(visible) != 1 || visible[0].Id != "1" {
+		t.Fatalf("expected only note 1, got %v", visible)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/russross/blackfriday"
+)
+
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type AtomEntry struct {
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  AtomAuthor  `xml:"author"`
+	Links   []AtomLink  `xml:"link"`
+	Content AtomContent `xml:"content"`
+}
+
+type AtomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri"`
+}
+
+type AtomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type RSSFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel RSSChannel `xml:"channel"`
+}
+
+type RSSChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []RSSItem `xml:"item"`
+}
+
+type RSSItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Guid        RSSGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type RSSGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func (s *Server) feed(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+	name := mux.Vars(r)["name"]
+	format := mux.Vars(r)["format"]
+
+	// same history join used by the activitypub outbox
+	match := ""
+	args := []interface{}{}
+	if owner != "" {
+		args = append(args, owner)
+		match += fmt.Sprintf("AND owner = $%d ", len(args))
+	}
+	if name != "" {
+		args = append(args, name)
+		match += fmt.Sprintf("AND name = $%d ", len(args))
+	}
+
+	dbnotes := make([]DBNote, 0)
+	err := s.pg.SelectContext(r.Context(), &dbnotes, `
+        SELECT
+            history.id::text AS id,
+            owner,
+            name,
+            set_at,
+            history.cid,
+            note,
+            body
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE state = 'visible' `+match+`
+        ORDER BY history.set_at DESC
+        LIMIT 50
+    `, args...)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+	dbnotes = s.visibleNotes(dbnotes)
+
+	title := s.ServiceName
+	path := "/"
+	feedpath := "/feed." + format
+	if owner != "" {
+		title += ": " + owner
+		path += owner
+		feedpath = "/" + owner + "." + format
+	}
+	if name != "" {
+		title += "/" + name
+		path += "/" + name
+		feedpath = "/" + owner + "/" + name + "." + format
+	}
+
+	updated := time.Now()
+	if len(dbnotes) > 0 {
+		updated = parseSetAt(dbnotes[0].SetAt)
+	}
+
+	var res interface{}
+	switch format {
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		atom := AtomFeed{
+			Title:   title,
+			Id:      s.ServiceURL + feedpath,
+			Updated: updated.Format(time.RFC3339),
+			Links: []AtomLink{
+				{Rel: "self", Type: "application/atom+xml", Href: s.ServiceURL + feedpath},
+				{Rel: "alternate", Type: "text/html", Href: s.ServiceURL + path},
+			},
+			Entries: make([]AtomEntry, len(dbnotes)),
+		}
+		for i, dbnote := range dbnotes {
+			atom.Entries[i] = AtomEntry{
+				Title:   dbnote.Owner + "/" + dbnote.Name + ": " + dbnote.CID,
+				Id:      s.ServiceURL + "/pub/note/" + dbnote.Id,
+				Updated: parseSetAt(dbnote.SetAt).Format(time.RFC3339),
+				Author: AtomAuthor{
+					Name: dbnote.Owner,
+					URI:  s.ServiceURL + "/" + dbnote.Owner,
+				},
+				Links: []AtomLink{
+					{Rel: "alternate", Type: "text/html",
+						Href: s.ServiceURL + "/" + dbnote.Owner + "/" + dbnote.Name},
+					{Rel: "related", Href: s.IPFSGateway + "/ipfs/" + dbnote.CID},
+				},
+				Content: AtomContent{Type: "html", Body: s.feedEntryContent(dbnote)},
+			}
+		}
+		res = atom
+	case "rss":
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		rss := RSSFeed{
+			Version: "2.0",
+			Channel: RSSChannel{
+				Title:         title,
+				Link:          s.ServiceURL + path,
+				Description:   title,
+				LastBuildDate: updated.Format(time.RFC1123Z),
+				Items:         make([]RSSItem, len(dbnotes)),
+			},
+		}
+		for i, dbnote := range dbnotes {
+			rss.Channel.Items[i] = RSSItem{
+				Title: dbnote.Owner + "/" + dbnote.Name + ": " + dbnote.CID,
+				Link:  s.IPFSGateway + "/ipfs/" + dbnote.CID,
+				Guid: RSSGuid{
+					IsPermaLink: false,
+					Value:       s.ServiceURL + "/pub/note/" + dbnote.Id,
+				},
+				PubDate:     parseSetAt(dbnote.SetAt).Format(time.RFC1123Z),
+				Description: s.feedEntryContent(dbnote),
+			}
+		}
+		res = rss
+	}
+
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("error encoding feed")
+	}
+}
+
+func (s *Server) feedEntryContent(dbnote DBNote) string {
+	content := ""
+	if dbnote.Note != "" {
+		content += "<p>" + html.EscapeString(dbnote.Note) + "</p>\n"
+	}
+	content += fmt.Sprintf(
+		"<p><code>%s</code>: <a href=\"%[2]s/ipfs/%[1]s\">%[2]s/ipfs/%[1]s</a></p>\n",
+		dbnote.CID, s.IPFSGateway)
+	if dbnote.Body != "" {
+		// bodies are written by users, markdown lets raw html through
+		content += sanitizeHTML(string(blackfriday.MarkdownCommon([]byte(dbnote.Body))))
+	}
+	return content
+}
+
+func parseSetAt(setAt string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, setAt)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeedEntryContent(t *testing.T) {
+	s := &Server{Settings: Settings{IPFSGateway: "https://ipfs.io"}}
+	content := s.feedEntryContent(DBNote{
+		CID:  testCID1,
+		Note: "<b>note</b>",
+		Body: "# title\n\n<script>alert(1)</script>\n\n[link](javascript:alert(1)) <img src=x onerror=alert(1)>",
+	})
+
+	for _, bad := range []string{"<script", "javascript:", "onerror", "<b>"} {
+		if strings.Contains(content, bad) {
+			t.Errorf("%s wasn't removed from %s", bad, content)
+		}
+	}
+	for _, good := range []string{"<h1>title</h1>", "&lt;b&gt;note", "https://ipfs.io/ipfs/" + testCID1} {
+		if !strings.Contains(content, good) {
+			t.Errorf("%s is missing from %s", good, content)
+		}
+	}
+}
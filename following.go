@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/gorilla/mux"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/tidwall/gjson"
+)
+
+type TimelineEntry struct {
+	Actor     string `json:"actor" db:"actor"`
+	CID       string `json:"cid" db:"cid"`
+	Content   string `json:"content" db:"content"`
+	URL       string `json:"url" db:"url"`
+	Published string `json:"published" db:"published_at"`
+}
+
+// things that look like CIDs: v0 base58 hashes and v1 in base32 or base58.
+var cidLike = regexp.MustCompile(
+	`\b(Qm[1-9A-HJ-NP-Za-km-z]{44}|b[a-z2-7]{58,}|z[1-9A-HJ-NP-Za-km-z]{46,})\b`)
+
+func (s *Server) getTimeline(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+
+	token := r.Header.Get("Token")
+	err := s.validateJWT(r.Context(), token, owner, map[string]interface{}{
+		"owner": owner,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("token", token).Msg("token data is invalid")
+		http.Error(w, "Token data is invalid: "+err.Error(), 401)
+		return
+	}
+
+	entries := make([]TimelineEntry, 0)
+	err = s.pg.SelectContext(r.Context(), &entries, `
+        SELECT actor, cid, content, url, published_at
+        FROM timeline
+        WHERE owner = $1
+        ORDER BY published_at DESC
+        LIMIT 100
+    `, owner)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	// notes stored before they were sanitized on the way in
+	for i := range entries {
+		entries[i].Content = sanitizeHTML(entries[i].Content)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// pubFollow makes owner follow a remote actor, given by its url or as
+// user@domain.
+func (s *Server) pubFollow(owner, target string) error {
+	actor, err := resolveActor(target)
+	if err != nil {
+		return err
+	}
+
+	inbox, _, err := fetchActorInboxes(actor)
+	if err != nil {
+		return err
+	}
+
+	follow := Activity{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Id: fmt.Sprintf("%s/pub/user/%s#follows/%d",
+				s.ServiceURL, owner, time.Now().UnixNano()),
+			Type: "Follow",
+		},
+		Actor:  s.ServiceURL + "/pub/user/" + owner,
+		Object: actor,
+	}
+
+	_, err = s.pg.Exec(`
+        INSERT INTO pub_following (owner, actor, inbox, follow_id)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (owner, actor) DO
+        UPDATE SET inbox = $3, follow_id = $4
+    `, owner, actor, inbox, follow.Id)
+	if err != nil {
+		return err
+	}
+
+	return s.pubEnqueueInbox(owner, inbox, follow.Id, follow)
+}
+
+func (s *Server) pubUnfollow(owner, target string) error {
+	actor, err := resolveActor(target)
+	if err != nil {
+		return err
+	}
+
+	var f struct {
+		FollowId string `db:"follow_id"`
+		Inbox    string `db:"inbox"`
+	}
+	err = s.pg.Get(&f, `
+        DELETE FROM pub_following
+        WHERE owner = $1 AND actor = $2
+        RETURNING follow_id, inbox
+    `, owner, actor)
+	if err != nil {
+		return err
+	}
+
+	undo := Activity{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Id:      f.FollowId + "/undo",
+			Type:    "Undo",
+		},
+		Actor: s.ServiceURL + "/pub/user/" + owner,
+		Object: Activity{
+			Base: litepub.Base{
+				Id:   f.FollowId,
+				Type: "Follow",
+			},
+			Actor:  s.ServiceURL + "/pub/user/" + owner,
+			Object: actor,
+		},
+	}
+
+	return s.pubEnqueueInbox(owner, f.Inbox, undo.Id, undo)
+}
+
+// pubFollowResponse marks one of our Follows as accepted or removes it if
+// it was rejected.
+func (s *Server) pubFollowResponse(typ, actor, followId string) (err error) {
+	if typ == "Accept" {
+		_, err = s.pg.Exec(`
+            UPDATE pub_following SET accepted = true
+            WHERE actor = $1 AND follow_id = $2
+        `, actor, followId)
+	} else {
+		_, err = s.pg.Exec(`
+            DELETE FROM pub_following
+            WHERE actor = $1 AND follow_id = $2
+        `, actor, followId)
+	}
+	return
+}
+
+// pubSaveTimeline imports the CIDs referenced in a note into the timelines
+// of everybody here who follows its author.
+func (s *Server) pubSaveTimeline(actor string, note gjson.Result) error {
+	// links may be in the text or in attachments
+	text := note.Get("content").String()
+	note.Get("attachment").ForEach(func(_, attachment gjson.Result) bool {
+		text += " " + attachment.Get("url").String() + " " + attachment.Get("href").String()
+		return true
+	})
+
+	cids := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range cidLike.FindAllString(text, -1) {
+		cid, err := gocid.Parse(match)
+		if err != nil || seen[cid.String()] {
+			continue
+		}
+		seen[cid.String()] = true
+		cids = append(cids, cid.String())
+	}
+	if len(cids) == 0 {
+		return nil
+	}
+
+	published, err := time.Parse(time.RFC3339, note.Get("published").String())
+	if err != nil {
+		published = time.Now()
+	}
+
+	url := note.Get("url").String()
+	if url == "" {
+		url = note.Get("id").String()
+	}
+
+	for _, cid := range cids {
+		_, err = s.pg.Exec(`
+            INSERT INTO timeline (owner, actor, object_id, cid, content, url, published_at)
+            SELECT owner, $1, $2, $3, $4, $5, $6
+            FROM pub_following
+            WHERE actor = $1 AND accepted
+            ON CONFLICT (owner, object_id, cid) DO UPDATE SET content = excluded.content
+            WHERE timeline.actor = excluded.actor
+        `, actor, note.Get("id").String(), cid, sanitizeHTML(note.Get("content").String()),
+			url, published.UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) pubDeleteTimeline(actor, objectId string) error {
+	_, err := s.pg.Exec(`
+        DELETE FROM timeline
+        WHERE actor = $1 AND object_id = $2
+    `, actor, objectId)
+	return err
+}
+
+// resolveActor turns user@domain into an actor url using webfinger.
+func resolveActor(target string) (string, error) {
+	if strings.HasPrefix(target, "https://") {
+		return target, nil
+	}
+	if strings.Contains(target, "://") {
+		return "", errors.New("actors must be https, not " + target)
+	}
+
+	account := strings.TrimPrefix(strings.TrimPrefix(target, "acct:"), "@")
+	parts := strings.Split(account, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.New("invalid account " + target)
+	}
+
+	resp, err := pubClient.Get("https://" + parts[1] +
+		"/.well-known/webfinger?resource=acct:" + url.QueryEscape(account))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fetchError{url: resp.Request.URL.String(), status: resp.StatusCode}
+	}
+
+	var jrd struct {
+		Links []WebfingerLink `json:"links"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jrd); err != nil {
+		return "", err
+	}
+	for _, link := range jrd.Links {
+		if link.Rel == "self" && strings.Contains(link.Type, "activity") {
+			return link.Href, nil
+		}
+	}
+
+	return "", errors.New("couldn't find an actor for " + target)
+}
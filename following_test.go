@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestResolveActor(t *testing.T) {
+	for _, test := range []struct {
+		target string
+		actor  string
+	}{
+		{"https://elsewhere.test/users/alice", "https://elsewhere.test/users/alice"},
+		{"http://elsewhere.test/users/alice", ""},
+		{"http://127.0.0.1:8080/admin", ""},
+		{"file:///etc/passwd", ""},
+		{"alice", ""},
+		{"@alice@", ""},
+	} {
+		actor, err := resolveActor(test.target)
+		if test.actor == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.target, actor)
+			}
+			continue
+		}
+		if err != nil || actor != test.actor {
+			t.Errorf("%s: got %s (%v), expected %s", test.target, actor, err, test.actor)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/gorilla/mux"
+)
+
+type FollowerInfo struct {
+	Actor   string `json:"actor" db:"follower"`
+	Pending bool   `json:"pending" db:"pending"`
+}
+
+type Relationships struct {
+	Followers []FollowerInfo `json:"followers"`
+	Blocks    []string       `json:"blocks"`
+}
+
+func (s *Server) pubUserRelationships(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+
+	token := r.Header.Get("Token")
+	err := s.validateJWT(r.Context(), token, owner, map[string]interface{}{
+		"owner": owner,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("token", token).Msg("token data is invalid")
+		http.Error(w, "Token data is invalid: "+err.Error(), 401)
+		return
+	}
+
+	rel := Relationships{Blocks: make([]string, 0)}
+	rel.Followers, err = s.store.ListFollowers(r.Context(), owner)
+	if err == nil {
+		err = s.pg.SelectContext(r.Context(), &rel.Blocks, `
+            SELECT target FROM pub_blocks
+            WHERE owner = $1
+            ORDER BY target
+        `, owner)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
+
+// pubRespondFollow queues an Accept or a Reject of a Follow for owner.
+func (s *Server) pubRespondFollow(typ, owner, follower, followId, inbox string) error {
+	response := Activity{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Type:    typ,
+			Id: s.ServiceURL + "/pub/" + strings.ToLower(typ) + "/" +
+				follower + "/" + owner,
+		},
+		Actor: s.ServiceURL + "/pub/user/" + owner,
+		Object: Activity{
+			Base: litepub.Base{
+				Id:   followId,
+				Type: "Follow",
+			},
+			Actor:  follower,
+			Object: s.ServiceURL + "/pub/user/" + owner,
+		},
+	}
+
+	return s.pubEnqueueInbox(owner, inbox, response.Id, response)
+}
+
+func (s *Server) pubApproveFollower(owner, follower string) error {
+	var f struct {
+		FollowId string `db:"follow_id"`
+		Inbox    string `db:"inbox"`
+	}
+	err := s.pg.Get(&f, `
+        UPDATE pub_user_followers SET pending = false
+        WHERE target = $1 AND follower = $2
+        RETURNING follow_id, inbox
+    `, owner, follower)
+	if err != nil {
+		return err
+	}
+
+	return s.pubRespondFollow("Accept", owner, follower, f.FollowId, f.Inbox)
+}
+
+func (s *Server) pubRejectFollower(owner, follower string) error {
+	var f struct {
+		FollowId string `db:"follow_id"`
+		Inbox    string `db:"inbox"`
+	}
+	err := s.pg.Get(&f, `
+        DELETE FROM pub_user_followers
+        WHERE target = $1 AND follower = $2
+        RETURNING follow_id, inbox
+    `, owner, follower)
+	if err != nil {
+		return err
+	}
+
+	return s.pubRespondFollow("Reject", owner, follower, f.FollowId, f.Inbox)
+}
+
+// pubBlock blocks an actor url or a whole domain from interacting with
+// owner, rejecting the followers it covers.
+func (s *Server) pubBlock(owner, target string) error {
+	_, err := s.pg.Exec(`
+        INSERT INTO pub_blocks (owner, target)
+        VALUES ($1, $2)
+        ON CONFLICT (owner, target) DO NOTHING
+    `, owner, target)
+	if err != nil {
+		return err
+	}
+
+	var followers []string
+	err = s.pg.Select(&followers, `
+        SELECT follower FROM pub_user_followers WHERE target = $1
+    `, owner)
+	if err != nil {
+		return err
+	}
+	for _, follower := range followers {
+		if s.pubIsBlocked(owner, follower) {
+			if err := s.pubRejectFollower(owner, follower); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) pubUnblock(owner, target string) error {
+	_, err := s.pg.Exec(`
+        DELETE FROM pub_blocks
+        WHERE owner = $1 AND target = $2
+    `, owner, target)
+	return err
+}
+
+// pubIsBlocked checks if owner has blocked actor or the domain it is in
+// (or any of its parent domains).
+func (s *Server) pubIsBlocked(owner, actor string) bool {
+	host := actor
+	if u, err := url.Parse(actor); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+
+	if s.pubInstanceBlocked(host) {
+		return true
+	}
+
+	var blocked bool
+	err := s.pg.Get(&blocked, `
+        SELECT count(*) > 0 FROM pub_blocks
+        WHERE owner = $1
+          AND (target = $2 OR target = $3 OR $3 LIKE '%.' || target)
+    `, owner, actor, host)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("actor", actor).
+			Msg("error checking blocks")
+	}
+	return blocked
+}
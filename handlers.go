@@ -6,45 +6,24 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strings"
 
 	"github.com/badoux/checkmail"
 	"github.com/gorilla/mux"
 	gocid "github.com/ipfs/go-cid"
+	"github.com/lib/pq"
 	"github.com/tidwall/gjson"
 )
 
-func queryCIDs(w http.ResponseWriter, r *http.Request) {
+func (s *Server) queryCIDs(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 	cid := strings.TrimSpace(r.URL.Query().Get("cid"))
 	if strings.HasPrefix(cid, "/ipfs/") {
 		cid = cid[6:]
 	}
 
-	var err error
-
-	match := ""
-	args := []interface{}{cid}
-	var entries []HistoryEntry
-
-	if owner != "" {
-		// just for one owner
-		match += `AND head.owner = $2 `
-		args = append(args, owner)
-	}
-
-	err = pg.Select(&entries, `
-        SELECT owner, name, set_at, history.cid, (
-          SELECT count(*) FROM history AS hc
-          WHERE hc.record_id = history.record_id
-            AND hc.set_at > history.set_at
-        ) AS nseq
-        FROM history 
-        INNER JOIN head ON history.record_id = head.id
-        WHERE history.cid = $1 `+match+`
-        ORDER BY updated_at DESC
-    `, args...)
-
+	entries, err := s.store.QueryCID(r.Context(), cid, owner)
 	if err != nil && err != sql.ErrNoRows {
 		log.Warn().Err(err).Str("owner", owner).Str("cid", cid).
 			Msg("error fetching stuff from database")
@@ -52,29 +31,17 @@ func queryCIDs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if entries == nil {
+	if entries == nil || s.denylist.Contains(cid) {
 		entries = make([]HistoryEntry, 0)
 	}
 
 	json.NewEncoder(w).Encode(entries)
 }
 
-func getUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 
-	userInfo := UserInfo{Stars: []string{}}
-	err := pg.Get(&userInfo, `
-        SELECT name, string_agg(target_owner || '/' || target_name, ',') AS raw_stars
-        FROM users
-        LEFT OUTER JOIN stars ON stars.source = users.name
-        WHERE name = $1
-        GROUP BY name
-    `, owner)
-
-	if userInfo.RawStars.Valid {
-		userInfo.Stars = strings.Split(userInfo.RawStars.String, ",")
-	}
-
+	userInfo, err := s.store.GetUser(r.Context(), owner)
 	if err != nil && err != sql.ErrNoRows {
 		log.Warn().Err(err).Str("owner", owner).Msg("error fetching stuff from database")
 		http.Error(w, "Error fetching data.", 500)
@@ -84,135 +51,128 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(userInfo)
 }
 
-func listNames(w http.ResponseWriter, r *http.Request) {
+func (s *Server) listNames(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 
-	var err error
-
-	var entries []Entry
-	if owner == "" {
-		// all records globally
-		err = pg.Select(&entries, `
-            SELECT
-              owner, name, cid, note,
-              count(stars) AS nstars
-            FROM head 
-            LEFT OUTER JOIN stars
-              ON target_owner = head.owner AND target_name = head.name
-            GROUP BY owner, name, cid, note, updated_at
-            ORDER BY updated_at DESC
-        `)
-	} else {
-		// all records for just one user
-		err = pg.Select(&entries, `
-            SELECT
-              owner, name, cid, note,
-              count(stars) AS nstars
-            FROM head
-            LEFT OUTER JOIN stars
-              ON target_owner = head.owner AND target_name = head.name
-            WHERE owner = $1
-            GROUP BY owner, name, cid, note, updated_at
-            ORDER BY updated_at DESC
-        `, owner)
-	}
-
+	entries, err := s.store.ListRecords(r.Context(), owner, r.URL.Query().Get("tag"))
 	if err != nil && err != sql.ErrNoRows {
 		log.Warn().Err(err).Str("owner", owner).Msg("error fetching stuff from database")
 		http.Error(w, "Error fetching data.", 500)
 		return
 	}
 
-	if entries == nil {
-		entries = make([]Entry, 0)
+	// records pointing to denied cids are hidden
+	visible := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !s.denylist.Contains(entry.CID) {
+			visible = append(visible, entry)
+		}
 	}
+	entries = visible
 
 	json.NewEncoder(w).Encode(entries)
 }
 
-func getName(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getName(w http.ResponseWriter, r *http.Request) {
+	if mux.Vars(r)["host"] != "" {
+		// read-only copy of a record from another gravity
+		s.getMirroredName(w, r)
+		return
+	}
+
 	owner := mux.Vars(r)["owner"]
 	name := mux.Vars(r)["name"]
 
 	// show specific key
-	query := `
-        WITH st AS (
-          SELECT count(*) AS nstars FROM stars
-          WHERE target_owner = $1 AND target_name = $2
-        )
-        SELECT owner, name, cid, note, nstars
-        FROM head, st
-        WHERE owner = $1 AND name = $2
-    `
-	if r.URL.Query().Get("full") == "1" {
-		query = `
-            WITH df AS (
-              SELECT id AS rid, owner, name, cid, note, body
-              FROM head
-              WHERE owner = $1 AND name = $2
-            ), ph AS (
-              SELECT array_agg(cid || '|' || set_at ORDER BY id DESC) AS r
-              FROM history
-              WHERE record_id = (SELECT rid FROM df)
-            ), st AS (
-              SELECT count(*) AS nstars FROM stars
-              WHERE target_owner = $1 AND target_name = $2
-            )
-            SELECT
-              owner, name, cid, note, body,
-              array_to_string(r, '~') AS raw_history,
-              nstars
-            FROM df, ph, st;
-        `
-	}
-
-	var entry Entry
-	err = pg.Get(&entry, query, owner, name)
+	entry, err := s.getRecord(r.Context(), owner, name, r.URL.Query().Get("full") == "1")
 	res := &entry
-	if err == sql.ErrNoRows {
+	if err == sql.ErrNoRows || entry.State == RecordHidden || s.denylist.Contains(entry.CID) {
 		res = nil
-		goto end
-	} else if err != nil && err != sql.ErrNoRows {
+	} else if entry.State == RecordTakenDown {
+		http.Error(w, "This record was taken down: "+entry.StateReason, 451)
+		return
+	} else if err != nil {
 		log.Warn().Err(err).Str("owner", owner).Str("name", name).
 			Msg("error fetching stuff from database")
 		http.Error(w, "Error fetching data.", 500)
 		return
 	}
 
-	if res.RawHistory.Valid {
-		hentries := strings.Split(res.RawHistory.String, "~")
-		res.History = make([]HistoryEntry, len(hentries))
-		for i, hentry := range hentries {
-			parts := strings.Split(hentry, "|")
-			res.History[i] = HistoryEntry{
-				CID:  parts[0],
-				Date: parts[1],
-			}
-		}
+	// comments stored before they were sanitized on the way in
+	for i := range entry.Comments {
+		entry.Comments[i].Content = sanitizeHTML(entry.Comments[i].Content)
 	}
 
-end:
 	json.NewEncoder(w).Encode(res)
 }
 
-func redirectName(w http.ResponseWriter, r *http.Request) {
+func (s *Server) redirectName(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 	name := mux.Vars(r)["name"]
 
-	var cid string
-	err = pg.Get(&cid, `
-        SELECT cid FROM head
-        WHERE owner = $1 AND name = $2
-    `, owner, name)
-	if err == sql.ErrNoRows {
+	entry, err := s.getRecord(r.Context(), owner, name, false)
+	if err == sql.ErrNoRows || entry.State == RecordHidden {
 		http.Error(w, "Couldn't find object.", 404)
 		return
+	} else if entry.State == RecordTakenDown {
+		http.Error(w, "This record was taken down: "+entry.StateReason, 451)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	} else if s.denylist.Contains(entry.CID) {
+		http.Error(w, "This content is blocked on this server.", 451)
+		return
+	}
+
+	http.Redirect(w, r, s.IPFSGateway+"/ipfs/"+entry.CID, 302)
+}
+
+// reservedNames are paths used by the server itself.
+var reservedNames = []string{
+	"admin", "pub", "r", "verify", "instance", "metrics", "nodeinfo", "feed",
+	"feed.atom", "feed.rss", "icon.svg", ".well-known", "authorize_interaction",
+}
+
+// reservedSuffixes would make users and records look like their feeds.
+var reservedSuffixes = []string{".atom", ".rss"}
+
+// validName is what user, record and alias names can be made of. they go in
+// urls and in the html of activitypub notes.
+var validName = regexp.MustCompile(`^[\w.-]+$`)
+
+const invalidNameMessage = "Invalid name, use only letters, digits, dots, dashes and underscores."
+
+// reservedRecordNames are paths under /{owner}/ used by the server itself.
+var reservedRecordNames = []string{"timeline"}
+
+// checkRecordName tells the client when name can't be used for a record or
+// an alias.
+func checkRecordName(w http.ResponseWriter, name string) bool {
+	if !validName.MatchString(name) {
+		http.Error(w, invalidNameMessage, 400)
+		return false
+	}
+	if isReserved(name, reservedRecordNames) {
+		http.Error(w, "This name is reserved.", 400)
+		return false
 	}
+	return true
+}
 
-	http.Redirect(w, r, "https://cloudflare-ipfs.com/ipfs/"+cid, 302)
+func isReserved(name string, reserved []string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range reservedSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return contains(reserved, name)
 }
 
-func registerUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) registerUser(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 	email := r.Header.Get("Email")
 	data, err := ioutil.ReadAll(r.Body)
@@ -222,6 +182,20 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 	}
 	pk := string(data)
 
+	if !s.OpenRegistrations {
+		http.Error(w, "Registrations are closed.", 403)
+		return
+	}
+
+	if !validName.MatchString(owner) {
+		http.Error(w, invalidNameMessage, 400)
+		return
+	}
+	if isReserved(owner, reservedNames) {
+		http.Error(w, "This name is reserved.", 400)
+		return
+	}
+
 	// register a new user at /owner
 	if err := checkmail.ValidateFormat(email); err != nil {
 		log.Warn().Err(err).Str("email", email).
@@ -230,11 +204,10 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = pg.Exec(`
-        INSERT INTO users (name, email, pk)
-        VALUES ($1, $2, $3)
-    `, owner, email, pk)
-
+	token, err := newVerificationToken()
+	if err == nil {
+		err = s.store.CreateUser(r.Context(), owner, email, pk, token)
+	}
 	if err != nil {
 		log.Warn().Err(err).Str("owner", owner).Str("email", email).
 			Msg("error creating user")
@@ -242,10 +215,16 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the account exists already, failing to send the email isn't fatal
+	if err := s.sendVerification(owner, email, token); err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("email", email).
+			Msg("error sending verification email")
+	}
+
 	w.WriteHeader(200)
 }
 
-func updateUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 
 	var data map[string]interface{}
@@ -256,7 +235,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	token := r.Header.Get("Token")
-	err = validateJWT(token, owner, map[string]interface{}{
+	err = s.validateJWT(r.Context(), token, owner, map[string]interface{}{
 		"owner": owner,
 	})
 	if err != nil {
@@ -265,43 +244,83 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.rateLimited(w, s.limits.userWrites, owner) {
+		return
+	}
+
+	// the special cases all take a string
+	for _, key := range []string{
+		"star", "unstar", "approve", "reject", "block", "unblock", "follow", "unfollow",
+	} {
+		if target, ok := data[key]; ok {
+			t, ok := target.(string)
+			if !ok {
+				http.Error(w, key+" must be a string.", 400)
+				return
+			}
+			if (key == "star" || key == "unstar") && len(strings.Split(t, "/")) != 2 {
+				http.Error(w, key+" must be owner/name.", 400)
+				return
+			}
+		}
+	}
+
+	// the rest of the special cases are about activitypub
+	if s.pg == nil {
+		for _, key := range []string{
+			"approve", "reject", "block", "unblock", "follow", "unfollow",
+		} {
+			if _, ok := data[key]; ok {
+				http.Error(w, errNoFederation.Error(), 501)
+				return
+			}
+		}
+	}
+
 	if target, ok := data["star"]; ok {
 		// special case: star
 		delete(data, "star")
 		parts := strings.Split(target.(string), "/")
 		target_owner := parts[0]
 		target_name := parts[1]
-		_, err = pg.Exec(`
-            INSERT INTO stars (source, target_owner, target_name)
-            VALUES ($1, $2, $3)
-            ON CONFLICT (source, target_owner, target_name) DO NOTHING
-        `, owner, target_owner, target_name)
+		err = s.store.Star(r.Context(), owner, target_owner, target_name)
 	} else if target, ok := data["unstar"]; ok {
 		// special case: unstar
 		delete(data, "unstar")
 		parts := strings.Split(target.(string), "/")
 		target_owner := parts[0]
 		target_name := parts[1]
-		_, err = pg.Exec(`
-            DELETE FROM stars
-            WHERE source = $1
-              AND target_owner = $2 AND target_name = $3
-        `, owner, target_owner, target_name)
+		err = s.store.Unstar(r.Context(), owner, target_owner, target_name)
+	} else if target, ok := data["approve"]; ok {
+		// special case: approve a pending activitypub follower
+		err = s.pubApproveFollower(owner, target.(string))
+	} else if target, ok := data["reject"]; ok {
+		// special case: reject (or remove) an activitypub follower
+		err = s.pubRejectFollower(owner, target.(string))
+	} else if target, ok := data["block"]; ok {
+		// special case: block an activitypub actor or domain
+		err = s.pubBlock(owner, target.(string))
+	} else if target, ok := data["unblock"]; ok {
+		// special case: unblock
+		err = s.pubUnblock(owner, target.(string))
+	} else if target, ok := data["follow"]; ok {
+		// special case: follow a remote actor
+		err = s.pubFollow(owner, target.(string))
+	} else if target, ok := data["unfollow"]; ok {
+		// special case: unfollow a remote actor
+		err = s.pubUnfollow(owner, target.(string))
 	} else {
-		setKeys := make([]string, len(data))
-		setValues := make([]interface{}, len(data)+1)
-		setValues[0] = owner
-		i := 0
-		for k, v := range data {
-			setKeys[i] = fmt.Sprintf("%s = $%v", k, i+2)
-			setValues[i+1] = v
-			i++
+		if len(data) == 0 {
+			http.Error(w, "Nothing to change.", 400)
+			return
+		}
+		for k := range data {
+			if !contains(UserFields, k) {
+				http.Error(w, "Can't change "+k+", only "+strings.Join(UserFields, ", ")+".", 400)
+				return
+			}
 		}
-		_, err = pg.Exec(`
-        UPDATE users SET
-        `+strings.Join(setKeys, ", ")+`
-        WHERE owner = $1
-    `, setValues...)
+		err = s.store.UpdateUser(r.Context(), owner, data)
 	}
 
 	if err != nil {
@@ -314,12 +333,12 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
-func setName(w http.ResponseWriter, r *http.Request) {
+func (s *Server) setName(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 	name := mux.Vars(r)["name"]
 
 	token := r.Header.Get("Token")
-	err = validateJWT(token, owner, map[string]interface{}{
+	err := s.validateJWT(r.Context(), token, owner, map[string]interface{}{
 		"owner": owner,
 		"name":  name,
 	})
@@ -331,9 +350,22 @@ func setName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.rateLimited(w, s.limits.userWrites, owner) {
+		return
+	}
+
+	if !s.requireVerified(w, r, owner, "Confirm your email address before publishing records.") {
+		return
+	}
+
+	if !checkRecordName(w, name) {
+		return
+	}
+
+	s.limitBody(w, r)
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Missing request body.", 400)
+		http.Error(w, "Request body too large.", 413)
 		return
 	}
 
@@ -349,17 +381,36 @@ func setName(w http.ResponseWriter, r *http.Request) {
 		cid = pcid.String()
 	}
 
-	var id string
-	err = pg.Get(&id, `
-        INSERT INTO head (owner, name, cid, note)
-        VALUES ($1, $2, $3, $4)
-        ON CONFLICT (owner, name) DO
-        UPDATE SET
-          cid = $3,
-          note = CASE WHEN character_length($4) > 0 THEN $4 ELSE head.note END,
-          updated_at = now()
-        RETURNING id::text
-    `, owner, name, cid, note)
+	if denied, err := s.store.IsCIDDenied(r.Context(), cid); err != nil {
+		log.Warn().Err(err).Str("cid", cid).Msg("error checking cid denylist")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	} else if denied || s.denylist.Contains(cid) {
+		http.Error(w, "This content was taken down and can't be published here.", 451)
+		return
+	}
+
+	if s.MaxRecordsPerUser > 0 {
+		// new records only
+		_, err = s.store.RecordCID(r.Context(), owner, name)
+		if err == sql.ErrNoRows {
+			var count int
+			count, err = s.store.CountRecords(r.Context(), owner)
+			if err == nil && count >= s.MaxRecordsPerUser {
+				http.Error(w, fmt.Sprintf("Quota exceeded: you can't have more than %d records.",
+					s.MaxRecordsPerUser), 403)
+				return
+			}
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("owner", owner).Str("name", name).
+				Msg("error checking record quota")
+			http.Error(w, "Error fetching data.", 500)
+			return
+		}
+	}
+
+	err = s.store.SetRecord(r.Context(), owner, name, cid, note)
 	if err != nil {
 		log.Warn().Err(err).Str("owner", owner).Str("name", name).
 			Msg("error upserting record")
@@ -367,19 +418,18 @@ func setName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// dispatch to activitypub
-	log.Print(id, " ", owner, " ", name, " ", cid)
-	go pubDispatchNote(id, owner, name, cid)
+	// queue for delivery to activitypub followers
+	s.inBackground(func() { s.pubDispatchNote(owner, name) })
 
 	w.WriteHeader(200)
 }
 
-func updateName(w http.ResponseWriter, r *http.Request) {
+func (s *Server) updateName(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 	name := mux.Vars(r)["name"]
 
 	token := r.Header.Get("Token")
-	err = validateJWT(token, owner, map[string]interface{}{
+	err := s.validateJWT(r.Context(), token, owner, map[string]interface{}{
 		"owner": owner,
 		"name":  name,
 	})
@@ -391,45 +441,93 @@ func updateName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.rateLimited(w, s.limits.userWrites, owner) {
+		return
+	}
+
+	if !s.requireVerified(w, r, owner, "Confirm your email address before editing records.") {
+		return
+	}
+
+	s.limitBody(w, r)
 	var data map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err = json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		http.Error(w, "Invalid JSON body.", 400)
 		return
 	}
 
-	setKeys := make([]string, len(data))
-	setValues := make([]interface{}, len(data)+2)
-	setValues[0] = owner
-	setValues[1] = name
-	i := 0
-	for k, v := range data {
-		setKeys[i] = fmt.Sprintf("%s = $%v", k, i+3)
-		setValues[i+2] = v
-		i++
+	for k := range data {
+		if k != "name" && !contains(RecordFields, k) {
+			http.Error(w, "Can't change "+k+", only name, "+strings.Join(RecordFields, ", ")+".", 400)
+			return
+		}
 	}
 
-	_, err = pg.Exec(`
-        UPDATE head SET
-        `+strings.Join(setKeys, ", ")+`
-        WHERE owner = $1 AND name = $2
-    `, setValues...)
-	if err != nil {
-		log.Warn().Err(err).Str("owner", owner).Str("name", name).
-			Msg("error updating record")
-		http.Error(w, "Error updating record: "+err.Error(), 500)
+	if body, ok := data["body"].(string); ok && s.MaxBodySize > 0 && len(body) > s.MaxBodySize {
+		http.Error(w, fmt.Sprintf("Body too large, the limit is %d bytes.", s.MaxBodySize), 413)
 		return
 	}
 
+	if raw, ok := data["tags"]; ok {
+		// special case: tags are stored as a postgres array
+		list, _ := raw.([]interface{})
+		data["tags"] = pq.Array(normalizeTags(list))
+	}
+
+	// followers only need to know about what shows up in the note,
+	// pinning doesn't
+	changesNote := false
+	for _, k := range []string{"note", "body", "tags"} {
+		if _, ok := data[k]; ok {
+			changesNote = true
+		}
+	}
+
+	if newName, ok := data["name"].(string); ok && newName != name {
+		if !checkRecordName(w, newName) {
+			return
+		}
+
+		// renames leave an alias behind
+		delete(data, "name")
+		err = s.store.RenameRecord(r.Context(), owner, name, newName)
+		if err != nil {
+			log.Warn().Err(err).Str("owner", owner).Str("name", name).
+				Str("new", newName).Msg("error renaming record")
+			http.Error(w, "Error renaming record: "+err.Error(), 500)
+			return
+		}
+		name = newName
+		changesNote = true
+	} else {
+		delete(data, "name")
+	}
+
+	if len(data) > 0 {
+		err = s.store.UpdateRecord(r.Context(), owner, name, data)
+		if err != nil {
+			log.Warn().Err(err).Str("owner", owner).Str("name", name).
+				Msg("error updating record")
+			http.Error(w, "Error updating record: "+err.Error(), 500)
+			return
+		}
+	}
+
+	// the text of the latest note changed, tell activitypub followers
+	if changesNote {
+		s.pubDispatchUpdate(owner, name)
+	}
+
 	w.WriteHeader(200)
 }
 
-func delName(w http.ResponseWriter, r *http.Request) {
+func (s *Server) delName(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 	name := mux.Vars(r)["name"]
 
 	token := r.Header.Get("Token")
-	err := validateJWT(token, owner, map[string]interface{}{
+	err := s.validateJWT(r.Context(), token, owner, map[string]interface{}{
 		"owner": owner,
 		"name":  name,
 	})
@@ -441,11 +539,11 @@ func delName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = pg.Exec(`
-        DELETE FROM head
-        WHERE owner = $1 AND name = $2
-    `, owner, name)
+	if s.rateLimited(w, s.limits.userWrites, owner) {
+		return
+	}
 
+	noteIds, err := s.store.DeleteRecord(r.Context(), owner, name)
 	if err != nil {
 		log.Warn().Err(err).Str("owner", owner).Str("name", name).
 			Msg("error updating record")
@@ -453,5 +551,7 @@ func delName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.pubDispatchDelete(owner, noteIds)
+
 	w.WriteHeader(200)
 }
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"database/sql"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+	"github.com/microcosm-cc/bluemonday"
 )
 
 type Entry struct {
@@ -17,8 +22,17 @@ type Entry struct {
 	Note       string         `json:"note,omitempty" db:"note"`
 	Body       string         `json:"body,omitempty" db:"body"`
 	NStars     int            `json:"nstars" db:"nstars"`
+	NShares    int            `json:"nshares" db:"nshares"`
+	Pinned     bool           `json:"pinned,omitempty" db:"pinned"`
+	Tags       pq.StringArray `json:"tags,omitempty" db:"tags"`
 	RawHistory sql.NullString `json:"-" db:"raw_history"`
 	History    []HistoryEntry `json:"history,omitempty"`
+	Comments   []Comment      `json:"comments,omitempty"`
+	Provenance *Provenance    `json:"provenance,omitempty"`
+	MovedTo    string         `json:"moved_to,omitempty"` // when fetched by an alias
+
+	State       string `json:"-" db:"state"`
+	StateReason string `json:"-" db:"state_reason"`
 }
 
 type HistoryEntry struct {
@@ -29,23 +43,63 @@ type HistoryEntry struct {
 	Nseq  int    `json:"nseq,omitempty" db:"nseq"` // negative number, distance from head
 }
 
+// htmlPolicy keeps formatting and links and drops scripts, styles and
+// anything else that could run in a reader's browser.
+var htmlPolicy = bluemonday.UGCPolicy()
+
+// sanitizeHTML is for html we didn't write, like remote replies or what
+// comes out of markdown from users.
+func sanitizeHTML(html string) string {
+	return htmlPolicy.Sanitize(html)
+}
+
+// parseRawHistory reads history aggregated by postgres as cid|date~cid|date.
+func parseRawHistory(raw string) []HistoryEntry {
+	hentries := strings.Split(raw, "~")
+	history := make([]HistoryEntry, 0, len(hentries))
+	for _, hentry := range hentries {
+		parts := strings.Split(hentry, "|")
+		if len(parts) < 2 {
+			continue
+		}
+		history = append(history, HistoryEntry{
+			CID:  parts[0],
+			Date: parts[1],
+		})
+	}
+	return history
+}
+
 type UserInfo struct {
 	Name     string         `json:"name" db:"name"`
 	RawStars sql.NullString `json:"-" db:"raw_stars"`
 	Stars    []string       `json:"stars"`
 }
 
-func validateJWT(token, owner string, claimsToValidate map[string]interface{}) error {
+func (s *Server) validateJWT(ctx context.Context, token, owner string, claimsToValidate map[string]interface{}) (err error) {
+	defer func() {
+		if err != nil {
+			s.metrics.jwtFailures.Inc()
+		}
+	}()
+
 	// we get a jwt we must validate
-	var pemstr string
-	err := pg.Get(&pemstr, "SELECT pk FROM users WHERE name = $1", owner)
+	pemstr, err := s.store.UserPublicKey(ctx, owner)
 	if err != nil {
 		return err
 	}
 
+	account, err := s.store.GetAccount(ctx, owner)
+	if err != nil {
+		return err
+	}
+	if account.SuspendedAt != nil {
+		return errors.New("Account suspended")
+	}
+
 	block, _ := pem.Decode([]byte(pemstr))
 	if block == nil || block.Type != "PUBLIC KEY" {
-		return err
+		return errors.New("Invalid public key")
 	}
 
 	pk, err := x509.ParsePKCS1PublicKey(block.Bytes)
@@ -76,3 +130,13 @@ func validateJWT(token, owner string, claimsToValidate map[string]interface{}) e
 
 	return nil
 }
+
+// limitBody stops reading r's body after what the largest valid request
+// would need, a record body of MaxBodySize plus room for everything else.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	limit := int64(1 << 20)
+	if size := int64(s.MaxBodySize) + 1<<16; size > limit {
+		limit = size
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseRawHistory(t *testing.T) {
+	for _, test := range []struct {
+		raw  string
+		cids []string
+	}{
+		{testCID1 + "|2018-12-01", []string{testCID1}},
+		{testCID2 + "|2018-12-02~" + testCID1 + "|2018-12-01", []string{testCID2, testCID1}},
+		{testCID1, nil},
+		{testCID1 + "~~" + testCID2 + "|2018-12-02", []string{testCID2}},
+		{"", nil},
+	} {
+		history := parseRawHistory(test.raw)
+		if len(history) != len(test.cids) {
+			t.Errorf("%q: got %d entries, expected %d", test.raw, len(history), len(test.cids))
+			continue
+		}
+		for i, cid := range test.cids {
+			if history[i].CID != cid {
+				t.Errorf("%q: entry %d is %s, expected %s", test.raw, i, history[i].CID, cid)
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// how far the Date header can be from our clock, same as mastodon.
+const signatureMaxSkew = 12 * time.Hour
+
+// public keys are refetched after this or whenever a signature fails
+// with the cached key (the remote may have rotated it).
+const publicKeyCacheTTL = 24 * time.Hour
+
+type cachedPublicKey struct {
+	owner   string
+	key     *rsa.PublicKey
+	fetched time.Time
+}
+
+var publicKeys = struct {
+	sync.Mutex
+	cache map[string]cachedPublicKey
+}{cache: make(map[string]cachedPublicKey)}
+
+// verifyRequest checks the HTTP Signature, Digest and Date of an incoming
+// activitypub request and returns the actor that owns the signing key.
+func verifyRequest(r *http.Request, body []byte) (signer string, err error) {
+	params, err := parseSignatureHeader(r.Header.Get("Signature"))
+	if err != nil {
+		return
+	}
+
+	keyId := params["keyId"]
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if keyId == "" || err != nil || len(signature) == 0 {
+		err = errors.New("Signature header is missing keyId or signature")
+		return
+	}
+	switch params["algorithm"] {
+	case "", "rsa-sha256", "hs2019":
+	default:
+		err = fmt.Errorf("unsupported signature algorithm %s", params["algorithm"])
+		return
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	for _, required := range []string{"(request-target)", "host", "date", "digest"} {
+		if !contains(headers, required) {
+			err = fmt.Errorf("signature doesn't cover %s", required)
+			return
+		}
+	}
+
+	// date must be recent so signed requests can't be replayed forever
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		err = errors.New("invalid Date header")
+		return
+	}
+	if skew := time.Since(date); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		err = errors.New("Date header is too far from now")
+		return
+	}
+
+	// digest must match the body we actually got
+	if err = verifyDigest(r.Header.Get("Digest"), body); err != nil {
+		return
+	}
+
+	signingString, err := buildSigningString(r, headers)
+	if err != nil {
+		return
+	}
+	hashed := sha256.Sum256([]byte(signingString))
+
+	owner, pk, err := fetchPublicKey(keyId, false)
+	if err != nil {
+		return
+	}
+	if rsa.VerifyPKCS1v15(pk, crypto.SHA256, hashed[:], signature) != nil {
+		// try again with a fresh key
+		owner, pk, err = fetchPublicKey(keyId, true)
+		if err != nil {
+			return
+		}
+		if err = rsa.VerifyPKCS1v15(pk, crypto.SHA256, hashed[:], signature); err != nil {
+			err = errors.New("invalid signature")
+			return
+		}
+	}
+
+	return owner, nil
+}
+
+// signRequest adds the Date, Digest and Signature headers to an outgoing
+// request the same way verifyRequest expects them on incoming ones.
+func signRequest(r *http.Request, body []byte, keyId string, sk *rsa.PrivateKey) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	sum := sha256.Sum256(body)
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	signingString, err := buildSigningString(r, headers)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, sk, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", `keyId="`+keyId+`",algorithm="rsa-sha256",headers="`+
+		strings.Join(headers, " ")+`",signature="`+base64.StdEncoding.EncodeToString(signature)+`"`)
+	return nil
+}
+
+func parseSignatureHeader(header string) (map[string]string, error) {
+	if header == "" {
+		return nil, errors.New("missing Signature header")
+	}
+
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("malformed Signature header")
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return params, nil
+}
+
+func buildSigningString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+		default:
+			values, ok := r.Header[http.CanonicalHeaderKey(h)]
+			if !ok {
+				return "", fmt.Errorf("signed header %s is missing", h)
+			}
+			value = strings.Join(values, ", ")
+		}
+		lines[i] = h + ": " + strings.TrimSpace(value)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func verifyDigest(header string, body []byte) error {
+	for _, digest := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(kv) != 2 || strings.ToUpper(kv[0]) != "SHA-256" {
+			continue
+		}
+
+		sum := sha256.Sum256(body)
+		if kv[1] != base64.StdEncoding.EncodeToString(sum[:]) {
+			return errors.New("Digest doesn't match body")
+		}
+		return nil
+	}
+	return errors.New("missing SHA-256 Digest header")
+}
+
+// fetchPublicKey gets the key identified by keyId from the remote server,
+// or from our cache if we have seen it recently.
+func fetchPublicKey(keyId string, refresh bool) (owner string, pk *rsa.PublicKey, err error) {
+	publicKeys.Lock()
+	cached, ok := publicKeys.cache[keyId]
+	publicKeys.Unlock()
+	if ok && !refresh && time.Since(cached.fetched) < publicKeyCacheTTL {
+		return cached.owner, cached.key, nil
+	}
+
+	// the key id is generally the actor url plus a fragment
+	j, err := fetchActor(strings.SplitN(keyId, "#", 2)[0])
+	if err != nil {
+		return
+	}
+
+	key := findKey(j, keyId)
+	pempub := key.Get("publicKeyPem").String()
+	owner = key.Get("owner").String()
+	if pempub == "" || owner == "" {
+		err = fmt.Errorf("couldn't find key %s", keyId)
+		return
+	}
+
+	// anyone can host a key saying it belongs to someone else, so the owner
+	// must be on the same server and list the key as its own.
+	if !sameOrigin(keyId, owner) {
+		err = fmt.Errorf("key %s is not on the same server as its owner %s", keyId, owner)
+		return
+	}
+	if j.Get("id").String() != owner {
+		var actor gjson.Result
+		actor, err = fetchActor(owner)
+		if err != nil {
+			return
+		}
+		if findKey(actor, keyId).Get("publicKeyPem").String() != pempub {
+			err = fmt.Errorf("%s doesn't have the key %s", owner, keyId)
+			return
+		}
+	}
+
+	pk, err = parsePublicKeyPEM(pempub)
+	if err != nil {
+		return
+	}
+
+	publicKeys.Lock()
+	publicKeys.cache[keyId] = cachedPublicKey{owner: owner, key: pk, fetched: time.Now()}
+	publicKeys.Unlock()
+
+	return owner, pk, nil
+}
+
+// findKey looks for keyId in a document that may be the actor, with one or
+// more keys inside, or the key itself.
+func findKey(j gjson.Result, keyId string) (key gjson.Result) {
+	keys := j.Get("publicKey")
+	if !keys.Exists() {
+		keys = j
+	}
+	if keys.IsArray() {
+		keys.ForEach(func(_, k gjson.Result) bool {
+			if k.Get("id").String() == keyId {
+				key = k
+				return false
+			}
+			return true
+		})
+	} else if keys.Get("id").String() == keyId {
+		key = keys
+	}
+	return
+}
+
+// sameOrigin is true when both urls have the same scheme and host.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil || ua.Host == "" {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host
+}
+
+func parsePublicKeyPEM(pempub string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pempub))
+	if block == nil {
+		return nil, errors.New("invalid public key pem")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsakey, ok := key.(*rsa.PublicKey); ok {
+			return rsakey, nil
+		}
+		return nil, errors.New("public key is not RSA")
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected pem block %s", block.Type)
+	}
+}
+
+func contains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
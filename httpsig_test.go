@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRemote is a remote instance serving actors and keys from a map.
+type fakeRemote struct {
+	*httptest.Server
+	docs map[string]interface{}
+}
+
+func newFakeRemote(t *testing.T) *fakeRemote {
+	f := &fakeRemote{docs: make(map[string]interface{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := f.docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/activity+json")
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// addActor serves an actor at path with sk as its main key.
+func (f *fakeRemote) addActor(t *testing.T, path string, sk *rsa.PrivateKey) (actor, keyId string) {
+	actor = f.URL + path
+	keyId = actor + "#main-key"
+	f.docs[path] = map[string]interface{}{
+		"id":   actor,
+		"type": "Person",
+		"publicKey": map[string]interface{}{
+			"id":           keyId,
+			"owner":        actor,
+			"publicKeyPem": publicKeyPEM(t, sk),
+		},
+	}
+	return
+}
+
+func newKey(t *testing.T) *rsa.PrivateKey {
+	sk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+func publicKeyPEM(t *testing.T, sk *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signedRequest is an inbox request signed like mastodon does it.
+func signedRequest(t *testing.T, sk *rsa.PrivateKey, keyId string, body []byte, date time.Time) *http.Request {
+	r := httptest.NewRequest("POST", "https://gravity.test/pub", bytes.NewReader(body))
+	r.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	sum := sha256.Sum256(body)
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	signingString, err := buildSigningString(r, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, sk, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Signature", `keyId="`+keyId+`",algorithm="rsa-sha256",headers="`+
+		strings.Join(headers, " ")+`",signature="`+base64.StdEncoding.EncodeToString(signature)+`"`)
+	return r
+}
+
+func TestVerifyRequest(t *testing.T) {
+	remote := newFakeRemote(t)
+	evil := newFakeRemote(t)
+
+	aliceKey := newKey(t)
+	alice, aliceKeyId := remote.addActor(t, "/users/alice", aliceKey)
+
+	// a key on another server claiming to be alice's
+	evilKey := newKey(t)
+	evilKeyId := evil.URL + "/keys/alice#main-key"
+	evil.docs["/keys/alice"] = map[string]interface{}{
+		"id":           evilKeyId,
+		"owner":        alice,
+		"publicKeyPem": publicKeyPEM(t, evilKey),
+	}
+
+	// a key on alice's server that alice doesn't list
+	rogueKey := newKey(t)
+	rogueKeyId := remote.URL + "/keys/rogue"
+	remote.docs["/keys/rogue"] = map[string]interface{}{
+		"id":           rogueKeyId,
+		"owner":        alice,
+		"publicKeyPem": publicKeyPEM(t, rogueKey),
+	}
+
+	body := []byte(`{"type":"Like","actor":"` + alice + `","object":"https://gravity.test/pub/note/1"}`)
+	other := []byte(`{"type":"Delete","actor":"` + alice + `","object":"https://gravity.test/pub/note/1"}`)
+
+	for _, test := range []struct {
+		name    string
+		request func() *http.Request
+		signer  string
+	}{
+		{
+			name: "valid",
+			request: func() *http.Request {
+				return signedRequest(t, aliceKey, aliceKeyId, body, time.Now())
+			},
+			signer: alice,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				r := signedRequest(t, aliceKey, aliceKeyId, body, time.Now())
+				r.Body = httptest.NewRequest("POST", "/", bytes.NewReader(other)).Body
+				return r
+			},
+		},
+		{
+			name: "tampered digest",
+			request: func() *http.Request {
+				r := signedRequest(t, aliceKey, aliceKeyId, body, time.Now())
+				sum := sha256.Sum256(other)
+				r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+				r.Body = httptest.NewRequest("POST", "/", bytes.NewReader(other)).Body
+				return r
+			},
+		},
+		{
+			name: "wrong key",
+			request: func() *http.Request {
+				return signedRequest(t, newKey(t), aliceKeyId, body, time.Now())
+			},
+		},
+		{
+			name: "expired",
+			request: func() *http.Request {
+				return signedRequest(t, aliceKey, aliceKeyId, body, time.Now().Add(-13*time.Hour))
+			},
+		},
+		{
+			name: "owner on another server",
+			request: func() *http.Request {
+				return signedRequest(t, evilKey, evilKeyId, body, time.Now())
+			},
+		},
+		{
+			name: "owner doesn't list the key",
+			request: func() *http.Request {
+				return signedRequest(t, rogueKey, rogueKeyId, body, time.Now())
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := test.request()
+			b := new(bytes.Buffer)
+			b.ReadFrom(r.Body)
+
+			signer, err := verifyRequest(r, b.Bytes())
+			if test.signer == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got signer %s", signer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if signer != test.signer {
+				t.Fatalf("signer is %s, expected %s", signer, test.signer)
+			}
+		})
+	}
+}
+
+// what we send must pass our own verification, other gravity instances
+// run the same code.
+func TestPubSignedRequest(t *testing.T) {
+	remote := newFakeRemote(t)
+	sk := newKey(t)
+	actor, keyId := remote.addActor(t, "/pub/user/alice", sk)
+
+	activity := map[string]interface{}{
+		"type":   "Follow",
+		"actor":  actor,
+		"object": "https://gravity.test/pub/user/bob",
+	}
+	r, err := pubSignedRequest("https://gravity.test/pub", activity, keyId, sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	b.ReadFrom(r.Body)
+
+	signer, err := verifyRequest(r, b.Bytes())
+	if err != nil {
+		t.Fatalf("our own request doesn't verify: %s", err)
+	}
+	if signer != actor {
+		t.Fatalf("signer is %s, expected %s", signer, actor)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+type Comment struct {
+	Author    string `json:"author" db:"author"`
+	URL       string `json:"url,omitempty" db:"url"`
+	Content   string `json:"content" db:"content"`
+	Published string `json:"published" db:"published_at"`
+}
+
+// remote Likes count as stars and Announces as shares.
+var interactionTables = map[string]string{
+	"Like":     "pub_likes",
+	"Announce": "pub_shares",
+}
+
+// pubTargetRecord finds the record to which one of our note (or create)
+// urls belongs. returns sql.ErrNoRows if it isn't ours, or if it is hidden
+// or taken down and anyState is false.
+func (s *Server) pubTargetRecord(object string, anyState bool) (recordId int, owner string, err error) {
+	var id string
+	for _, prefix := range []string{"/pub/note/", "/pub/create/"} {
+		if strings.HasPrefix(object, s.ServiceURL+prefix) {
+			id = strings.TrimPrefix(object, s.ServiceURL+prefix)
+			break
+		}
+	}
+	if _, err := strconv.Atoi(id); err != nil {
+		return 0, "", sql.ErrNoRows
+	}
+
+	row := s.pg.QueryRow(`
+        SELECT record_id, owner
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE history.id = $1 AND ($2 OR state = 'visible')
+    `, id, anyState)
+	err = row.Scan(&recordId, &owner)
+	return
+}
+
+func (s *Server) pubSaveInteraction(typ, actor string, activity gjson.Result) error {
+	recordId, owner, err := s.pubTargetRecord(pubObjectId(activity.Get("object")), false)
+	if err != nil {
+		return err
+	}
+	if s.pubIsBlocked(owner, actor) {
+		return nil
+	}
+
+	_, err = s.pg.Exec(`
+        INSERT INTO `+interactionTables[typ]+` (actor, record_id, activity_id)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (actor, record_id) DO UPDATE SET activity_id = $3
+    `, actor, recordId, activity.Get("id").String())
+	return err
+}
+
+func (s *Server) pubUndoInteraction(typ, actor string, activity gjson.Result) error {
+	if target := activity.Get("object"); target.Exists() {
+		// undoing works whatever the state of the record is
+		recordId, _, err := s.pubTargetRecord(pubObjectId(target), true)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.pg.Exec(`
+            DELETE FROM `+interactionTables[typ]+`
+            WHERE actor = $1 AND record_id = $2
+        `, actor, recordId)
+		return err
+	}
+
+	// we only got the id of the activity being undone
+	_, err := s.pg.Exec(`
+        DELETE FROM `+interactionTables[typ]+`
+        WHERE actor = $1 AND activity_id = $2
+    `, actor, pubObjectId(activity))
+	return err
+}
+
+// pubSaveReply stores a remote note replying to one of our notes as a
+// comment on the record.
+func (s *Server) pubSaveReply(actor string, note gjson.Result) error {
+	recordId, owner, err := s.pubTargetRecord(note.Get("inReplyTo").String(), false)
+	if err != nil {
+		return err
+	}
+	if s.pubIsBlocked(owner, actor) {
+		return nil
+	}
+
+	published, err := time.Parse(time.RFC3339, note.Get("published").String())
+	if err != nil {
+		published = time.Now()
+	}
+
+	url := note.Get("url").String()
+	if url == "" {
+		url = note.Get("id").String()
+	}
+
+	// only the author can edit a comment
+	_, err = s.pg.Exec(`
+        INSERT INTO comments (record_id, author, object_id, content, url, published_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (object_id) DO UPDATE SET content = excluded.content
+        WHERE comments.author = excluded.author
+    `, recordId, actor, note.Get("id").String(), sanitizeHTML(note.Get("content").String()),
+		url, published.UTC())
+	return err
+}
+
+func (s *Server) pubDeleteReply(actor, objectId string) error {
+	_, err := s.pg.Exec(`
+        DELETE FROM comments
+        WHERE author = $1 AND object_id = $2
+    `, actor, objectId)
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text emails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+func newMailer(s Settings) (Mailer, error) {
+	switch s.Mailer {
+	case "smtp":
+		if s.SMTPHost == "" || s.MailFrom == "" {
+			return nil, errors.New("SMTP_HOST and MAIL_FROM are required for the smtp mailer")
+		}
+		return SMTPMailer{
+			Addr: s.SMTPHost + ":" + s.SMTPPort,
+			Host: s.SMTPHost,
+			User: s.SMTPUser,
+			Pass: s.SMTPPassword,
+			From: s.MailFrom,
+		}, nil
+	case "file":
+		return &FileMailer{Path: s.MailFile}, nil
+	case "stdout":
+		return &FileMailer{}, nil
+	default:
+		return nil, errors.New("unknown mailer '" + s.Mailer + "'")
+	}
+}
+
+type SMTPMailer struct {
+	Addr string
+	Host string
+	User string
+	Pass string
+	From string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.User != "" {
+		auth = smtp.PlainAuth("", m.User, m.Pass, m.Host)
+	}
+
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg))
+}
+
+// FileMailer appends emails to a file instead of sending them, or writes
+// them to stdout when there's no Path. it is meant for local testing.
+type FileMailer struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out io.Writer = os.Stdout
+	if m.Path != "" {
+		f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	_, err := fmt.Fprintf(out, "To: %s\nSubject: %s\n\n%s\n\n", to, subject, body)
+	return err
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
-	"fmt"
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/fiatjaf/litepub"
-	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
 	_ "github.com/lib/pq"
@@ -19,132 +16,111 @@ import (
 )
 
 type Settings struct {
-	ServiceName   string `envconfig:"SERVICE_NAME" required:"true"`
-	ServiceURL    string `envconfig:"SERVICE_URL" required:"true"`
-	Port          string `envconfig:"PORT" required:"true"`
-	PostgresURL   string `envconfig:"DATABASE_URL" required:"true"`
-	IconSVG       string `envconfig:"ICON"`
-	PrivateKeyPEM string `envconfig:"PRIVATE_KEY"`
-	PrivateKey    *rsa.PrivateKey
-	PublicKey     rsa.PublicKey
-	PublicKeyPEM  string
+	ServiceName string   `envconfig:"SERVICE_NAME" required:"true"`
+	ServiceURL  string   `envconfig:"SERVICE_URL" required:"true"`
+	Port        string   `envconfig:"PORT" required:"true"`
+	PostgresURL string   `envconfig:"DATABASE_URL"`
+	Storage     string   `envconfig:"STORAGE" default:"postgres"`
+	SQLitePath  string   `envconfig:"SQLITE_PATH" default:"gravity.db"`
+	IconSVG     string   `envconfig:"ICON"`
+	AdminToken  string   `envconfig:"ADMIN_TOKEN"`
+	Admins      []string `envconfig:"ADMINS"`
+	IPFSGateway string   `envconfig:"IPFS_GATEWAY" default:"https://ipfs.io"`
+
+	OpenRegistrations bool `envconfig:"OPEN_REGISTRATIONS" default:"true"`
+
+	PubDeliveryConcurrency int `envconfig:"PUB_DELIVERY_CONCURRENCY" default:"8"`
+	PubDeliveryMaxAttempts int `envconfig:"PUB_DELIVERY_MAX_ATTEMPTS" default:"12"`
+
+	MirrorInterval time.Duration `envconfig:"MIRROR_INTERVAL" default:"10m"`
+
+	// per ip, and per user for writes. 0 means no limit.
+	RegistrationsPerHour int  `envconfig:"LIMIT_REGISTRATIONS_PER_HOUR" default:"5"`
+	WritesPerMinute      int  `envconfig:"LIMIT_WRITES_PER_MINUTE" default:"30"`
+	InboxPerMinute       int  `envconfig:"LIMIT_INBOX_PER_MINUTE" default:"120"`
+	TrustProxy           bool `envconfig:"TRUST_PROXY"`
+
+	MaxRecordsPerUser int `envconfig:"MAX_RECORDS_PER_USER" default:"1000"`
+	MaxBodySize       int `envconfig:"MAX_BODY_SIZE" default:"65536"`
+
+	// mailer is smtp, file (to MAIL_FILE) or stdout
+	Mailer       string `envconfig:"MAILER" default:"stdout"`
+	MailFile     string `envconfig:"MAIL_FILE" default:"mail.txt"`
+	MailFrom     string `envconfig:"MAIL_FROM"`
+	SMTPHost     string `envconfig:"SMTP_HOST"`
+	SMTPPort     string `envconfig:"SMTP_PORT" default:"587"`
+	SMTPUser     string `envconfig:"SMTP_USER"`
+	SMTPPassword string `envconfig:"SMTP_PASSWORD"`
+
+	// a badbits denylist file, checked for changes periodically
+	DenylistFile           string        `envconfig:"DENYLIST_FILE"`
+	DenylistReloadInterval time.Duration `envconfig:"DENYLIST_RELOAD_INTERVAL" default:"30s"`
+
+	// unverified users can't set records after this
+	VerificationGracePeriod time.Duration `envconfig:"VERIFICATION_GRACE_PERIOD" default:"24h"`
 }
 
-var err error
-var s Settings
-var r *mux.Router
-var pub litepub.LitePub
-var pg *sqlx.DB
 var log = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
 func main() {
-	err = envconfig.Process("", &s)
-	if err != nil {
-		log.Fatal().Err(err).Msg("couldn't process envconfig.")
-	}
-
-	// key stuff (needed for the activitypub integration)
-	if s.PrivateKeyPEM != "" {
-		s.PrivateKeyPEM = strings.Replace(s.PrivateKeyPEM, "$$", "\n", -1)
-		decodedskpem, _ := pem.Decode([]byte(s.PrivateKeyPEM))
-
-		sk, err := x509.ParsePKCS1PrivateKey(decodedskpem.Bytes)
+	// `migrate up|down|status` only needs the database
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, err := sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
 		if err != nil {
-			log.Fatal().Err(err).Msg("couldn't process private key pem.")
+			log.Fatal().Err(err).Msg("couldn't connect to postgres")
 		}
-
-		s.PrivateKey = sk
-		s.PublicKey = sk.PublicKey
-
-		key, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
-		if err != nil {
-			log.Fatal().Err(err).Msg("couldn't marshal public key to pem.")
+		if err := runMigrateCommand(db, os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("migrate failed")
 		}
-		s.PublicKeyPEM = string(pem.EncodeToMemory(&pem.Block{
-			Type:  "PUBLIC KEY",
-			Bytes: key,
-		}))
+		return
 	}
 
-	pub = litepub.LitePub{
-		PrivateKey: s.PrivateKey,
+	var settings Settings
+	err := envconfig.Process("", &settings)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't process envconfig.")
 	}
 
+	settings.IPFSGateway = strings.TrimSuffix(settings.IPFSGateway, "/")
+
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	log = log.With().Timestamp().Logger()
 
-	// postgres connection
-	pg, err = sqlx.Connect("postgres", s.PostgresURL)
+	// database connection
+	store, err := openStorage(settings)
 	if err != nil {
-		log.Fatal().Err(err).Msg("couldn't connect to postgres")
+		log.Fatal().Err(err).Str("storage", settings.Storage).
+			Msg("couldn't open storage")
 	}
 
-	// define routes
-	r = mux.NewRouter()
-	r.Path("/icon.svg").Methods("GET").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "image/svg+xml")
-			fmt.Fprint(w, s.IconSVG)
-			return
-		})
-
-	r.Path("/pub").HandlerFunc(pubInbox)
-	r.Path("/pub/user/{owner:[\\d\\w-]+}").Methods("GET").HandlerFunc(pubUserActor)
-	r.Path("/pub/user/{owner:[\\d\\w-]+}/followers").Methods("GET").HandlerFunc(pubUserFollowers)
-	r.Path("/pub/user/{owner:[\\d\\w-]+}/outbox").Methods("GET").HandlerFunc(pubOutbox)
-	r.Path("/pub/create/{id}").Methods("GET").HandlerFunc(pubCreate)
-	r.Path("/pub/note/{id}").Methods("GET").HandlerFunc(pubNote)
-	r.Path("/.well-known/webfinger").HandlerFunc(webfinger)
-
-	r.Path("/{owner}").Methods("POST").HandlerFunc(registerUser)
-	r.Path("/{owner}/").Methods("POST").HandlerFunc(registerUser)
-
-	r.Path("/{owner}").Methods("PATCH").HandlerFunc(updateUser)
-	r.Path("/{owner}/").Methods("PATCH").HandlerFunc(updateUser)
-
-	r.Path("/{owner}/{name}").Methods("PUT").HandlerFunc(setName)
-	r.Path("/{owner}/{name}/").Methods("PUT").HandlerFunc(setName)
-
-	r.Path("/{owner}/{name}").Methods("PATCH").HandlerFunc(updateName)
-	r.Path("/{owner}/{name}/").Methods("PATCH").HandlerFunc(updateName)
-
-	r.Path("/{owner}/{name}").Methods("DELETE").HandlerFunc(delName)
-	r.Path("/{owner}/{name}/").Methods("DELETE").HandlerFunc(delName)
-
-	r.Path("/").Methods("GET").Queries("cid", "").
-		HandlerFunc(switchHTMLJSON(queryCIDs))
-	r.Path("/{owner:[\\d\\w-]+}").Methods("GET").Queries("cid", "").
-		HandlerFunc(switchHTMLJSON(queryCIDs))
-	r.Path("/{owner:[\\d\\w-]+}/").Methods("GET").Queries("cid", "").
-		HandlerFunc(switchHTMLJSON(queryCIDs))
-
-	r.Path("/{owner:[\\d\\w-]+}").Methods("GET").
-		HandlerFunc(switchHTMLJSON(getUser))
-
-	r.Path("/").Methods("GET").
-		HandlerFunc(switchHTMLJSON(listNames))
-	r.Path("/{owner:[\\d\\w-]+}/").Methods("GET").
-		HandlerFunc(switchHTMLJSON(listNames))
+	mailer, err := newMailer(settings)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't set up the mailer")
+	}
 
-	r.Path("/{owner:[\\d\\w-]+}/{name:[\\d\\w-.]+}").Methods("GET").
-		HandlerFunc(switchHTMLJSON(getName))
-	r.Path("/{owner:[\\d\\w-]+}/{name:[\\d\\w-.]+}/").Methods("GET").
-		HandlerFunc(switchHTMLJSON(getName))
+	s := NewServer(settings, store, mailer)
 
-	r.Path("/r/{owner}/{name}").Methods("GET").HandlerFunc(redirectName)
-	r.Path("/r/{owner}/{name}/").Methods("GET").HandlerFunc(redirectName)
+	// on SIGTERM finish what we're doing before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	stopped := make(chan struct{})
+	go func() {
+		<-stop
+		log.Info().Msg("shutting down.")
 
-	r.PathPrefix("/").Methods("GET").Handler(http.FileServer(http.Dir("./static")))
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("unclean shutdown")
+		}
+		close(stopped)
+	}()
 
 	// start the server
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         "0.0.0.0:" + s.Port,
-		WriteTimeout: 25 * time.Second,
-		ReadTimeout:  25 * time.Second,
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatal().Err(err).Msg("server failed")
 	}
-	log.Info().Str("port", s.Port).Msg("listening.")
-	srv.ListenAndServe()
+	<-stopped
 }
 
 func switchHTMLJSON(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	queryDuration   *prometheus.HistogramVec
+	deliveries      *prometheus.CounterVec
+	jwtFailures     prometheus.Counter
+	rateLimited     *prometheus.CounterVec
+}
+
+func newMetrics(s *Server) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gravity_http_requests_total",
+			Help: "HTTP requests by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gravity_http_request_duration_seconds",
+			Help:    "Time taken to answer HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gravity_db_query_duration_seconds",
+			Help:    "Time taken by storage operations.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"op"}),
+		deliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gravity_pub_deliveries_total",
+			Help: "ActivityPub delivery attempts by outcome (delivered, retry or dead).",
+		}, []string{"outcome"}),
+		jwtFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gravity_jwt_validation_failures_total",
+			Help: "Requests with a missing or invalid token.",
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gravity_rate_limited_total",
+			Help: "Requests refused with 429, by limit.",
+		}, []string{"limit"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.queryDuration, m.deliveries, m.jwtFailures,
+		m.rateLimited,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	// totals are read from the database at scrape time
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gravity_users",
+		Help: "Registered users.",
+	}, func() float64 {
+		stats, _ := s.store.Stats(context.Background())
+		return float64(stats.Users)
+	}))
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gravity_records",
+		Help: "Records across all users.",
+	}, func() float64 {
+		stats, _ := s.store.Stats(context.Background())
+		return float64(stats.Records)
+	}))
+
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests is a middleware that writes an access log line and updates
+// the http metrics for every request.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		next.ServeHTTP(sw, r)
+		took := time.Since(start)
+
+		// the route template keeps the number of labels bounded
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		s.metrics.requests.WithLabelValues(r.Method, route, strconv.Itoa(sw.status)).Inc()
+		s.metrics.requestDuration.WithLabelValues(r.Method, route).Observe(took.Seconds())
+
+		log.Info().Str("method", r.Method).Str("route", route).
+			Str("path", r.URL.Path).Int("status", sw.status).
+			Dur("latency", took).Str("owner", mux.Vars(r)["owner"]).
+			Msg("request")
+	})
+}
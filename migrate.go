@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type AppliedMigration struct {
+	Version   int    `db:"version"`
+	Name      string `db:"name"`
+	AppliedAt string `db:"applied_at"`
+}
+
+// any number, just so concurrent servers don't migrate at the same time.
+const migrationsLockId = 4772
+
+func ensureMigrationsTable(db *sqlx.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+          version int PRIMARY KEY,
+          name text NOT NULL,
+          applied_at timestamp NOT NULL DEFAULT now()
+        )
+    `)
+	return err
+}
+
+func appliedMigrations(db *sqlx.DB) (map[int]AppliedMigration, error) {
+	var applied []AppliedMigration
+	err := db.Select(&applied, `
+        SELECT version, name, applied_at FROM schema_migrations ORDER BY version
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]AppliedMigration, len(applied))
+	for _, m := range applied {
+		byVersion[m.Version] = m
+	}
+	return byVersion, nil
+}
+
+// migrateUp applies all pending migrations, each in its own transaction.
+func migrateUp(db *sqlx.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		txn, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationsLockId)
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		var done bool
+		err = txn.Get(&done, `
+            SELECT count(*) > 0 FROM schema_migrations WHERE version = $1
+        `, m.Version)
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+		if done {
+			txn.Rollback()
+			continue
+		}
+
+		log.Info().Int("version", m.Version).Str("name", m.Name).Msg("applying migration")
+		_, err = txn.Exec(m.Up)
+		if err == nil {
+			_, err = txn.Exec(`
+                INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+            `, m.Version, m.Name)
+		}
+		if err != nil {
+			txn.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDown reverts the latest applied migration.
+func migrateDown(db *sqlx.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+
+	txn, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationsLockId)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = txn.Get(&version, `SELECT coalesce(max(version), 0) FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return errors.New("no migrations to revert")
+	}
+
+	for _, m := range migrations {
+		if m.Version != version {
+			continue
+		}
+
+		log.Info().Int("version", m.Version).Str("name", m.Name).Msg("reverting migration")
+		_, err = txn.Exec(m.Down)
+		if err == nil {
+			_, err = txn.Exec(`DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+		}
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+		return txn.Commit()
+	}
+
+	return fmt.Errorf("migration %d is applied but unknown to this version of gravity", version)
+}
+
+func migrateStatus(db *sqlx.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 3, 3, 2, ' ', 0)
+	for _, m := range migrations {
+		status := "pending"
+		if a, ok := applied[m.Version]; ok {
+			status = "applied at " + a.AppliedAt
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, status)
+	}
+	return tw.Flush()
+}
+
+// runMigrateCommand handles `gravity migrate up|down|status`.
+func runMigrateCommand(db *sqlx.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp(db)
+	case "down":
+		return migrateDown(db)
+	case "status":
+		return migrateStatus(db)
+	default:
+		return errors.New("usage: migrate up|down|status")
+	}
+}
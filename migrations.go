@@ -0,0 +1,479 @@
+package main
+
+// migrations are applied in order by migrateUp. never change one that has
+// already been released, add a new one instead.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		// databases created with the old postgres.sql already have some of
+		// these tables, so everything here must be safe to run on top of them.
+		Up: `
+CREATE TABLE IF NOT EXISTS users (
+  name text PRIMARY KEY,
+  email text NOT NULL,
+  pk text
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS actor_sk text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS manually_approves_followers boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS head (
+  id serial PRIMARY KEY,
+  owner text NOT NULL REFERENCES users (name),
+  name text NOT NULL,
+  cid text NOT NULL,
+  updated_at timestamp NOT NULL DEFAULT now(),
+  note text NOT NULL DEFAULT '',
+  body text NOT NULL DEFAULT '',
+
+  UNIQUE (owner, name),
+  CONSTRAINT check_owner CHECK (owner ~ '[\w\d.-]+'),
+  CONSTRAINT check_name CHECK (name ~ '[\w\d.-]+'),
+  CONSTRAINT check_owner_size CHECK (character_length(owner) <= 35),
+  CONSTRAINT check_name_size CHECK (character_length(name) <= 50),
+  CONSTRAINT check_note_size CHECK (character_length(note) <= 280)
+);
+
+ALTER TABLE head ADD COLUMN IF NOT EXISTS pinned boolean NOT NULL DEFAULT false;
+ALTER TABLE head ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS head_owner_idx ON head (owner);
+CREATE INDEX IF NOT EXISTS head_name_idx ON head (name);
+CREATE INDEX IF NOT EXISTS head_cid_idx ON head (cid);
+CREATE INDEX IF NOT EXISTS head_tags_idx ON head USING gin (tags);
+
+CREATE TABLE IF NOT EXISTS history (
+  id serial PRIMARY KEY,
+  record_id int NOT NULL REFERENCES head (id) ON DELETE CASCADE,
+  set_at timestamp NOT NULL DEFAULT now(),
+  cid text NOT NULL,
+  prev int
+);
+
+ALTER TABLE history ADD COLUMN IF NOT EXISTS media_type text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS history_record_id_idx ON history (record_id);
+
+CREATE OR REPLACE FUNCTION update_history() RETURNS trigger AS $$
+  DECLARE
+    previous int;
+  BEGIN
+    IF TG_OP = 'UPDATE' THEN
+      SELECT id INTO previous FROM history
+        WHERE record_id = NEW.id
+        ORDER BY id DESC LIMIT 1;
+    END IF;
+
+    INSERT INTO history (record_id, cid, prev)
+      VALUES (NEW.id, NEW.cid, previous);
+
+    RETURN NULL;
+  END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS update_history_ins ON head;
+CREATE TRIGGER update_history_ins AFTER INSERT ON head
+  FOR EACH ROW EXECUTE PROCEDURE update_history();
+DROP TRIGGER IF EXISTS update_history_upd ON head;
+CREATE TRIGGER update_history_upd AFTER UPDATE OF cid ON head
+  FOR EACH ROW WHEN (NEW.cid != OLD.cid) EXECUTE PROCEDURE update_history();
+
+CREATE TABLE IF NOT EXISTS stars (
+  source text NOT NULL REFERENCES users (name),
+  target_owner text NOT NULL,
+  target_name text NOT NULL,
+  starred_at timestamp NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (target_owner, target_name) REFERENCES head (owner, name),
+  UNIQUE (source, target_owner, target_name)
+);
+
+CREATE TABLE IF NOT EXISTS pub_user_followers (
+  follower text NOT NULL,
+  target text NOT NULL REFERENCES users (name),
+
+  UNIQUE (follower, target)
+);
+
+ALTER TABLE pub_user_followers ADD COLUMN IF NOT EXISTS inbox text NOT NULL DEFAULT '';
+ALTER TABLE pub_user_followers ADD COLUMN IF NOT EXISTS shared_inbox text NOT NULL DEFAULT '';
+ALTER TABLE pub_user_followers ADD COLUMN IF NOT EXISTS follow_id text NOT NULL DEFAULT '';
+ALTER TABLE pub_user_followers ADD COLUMN IF NOT EXISTS pending boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS pub_following (
+  owner text NOT NULL REFERENCES users (name),
+  actor text NOT NULL,
+  inbox text NOT NULL,
+  follow_id text NOT NULL,
+  accepted boolean NOT NULL DEFAULT false,
+  created_at timestamp NOT NULL DEFAULT now(),
+
+  UNIQUE (owner, actor)
+);
+
+CREATE TABLE IF NOT EXISTS timeline (
+  id serial PRIMARY KEY,
+  owner text NOT NULL REFERENCES users (name),
+  actor text NOT NULL,
+  object_id text NOT NULL,
+  cid text NOT NULL,
+  content text NOT NULL,
+  url text NOT NULL DEFAULT '',
+  published_at timestamp NOT NULL,
+
+  UNIQUE (owner, object_id, cid)
+);
+
+CREATE INDEX IF NOT EXISTS timeline_owner_published_at_idx ON timeline (owner, published_at);
+
+CREATE TABLE IF NOT EXISTS pub_blocks (
+  owner text NOT NULL REFERENCES users (name),
+  target text NOT NULL,
+  created_at timestamp NOT NULL DEFAULT now(),
+
+  UNIQUE (owner, target)
+);
+
+CREATE TABLE IF NOT EXISTS pub_likes (
+  actor text NOT NULL,
+  record_id int NOT NULL REFERENCES head (id) ON DELETE CASCADE,
+  activity_id text NOT NULL,
+  created_at timestamp NOT NULL DEFAULT now(),
+
+  UNIQUE (actor, record_id)
+);
+
+CREATE TABLE IF NOT EXISTS pub_shares (
+  actor text NOT NULL,
+  record_id int NOT NULL REFERENCES head (id) ON DELETE CASCADE,
+  activity_id text NOT NULL,
+  created_at timestamp NOT NULL DEFAULT now(),
+
+  UNIQUE (actor, record_id)
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+  id serial PRIMARY KEY,
+  record_id int NOT NULL REFERENCES head (id) ON DELETE CASCADE,
+  author text NOT NULL,
+  object_id text NOT NULL UNIQUE,
+  content text NOT NULL,
+  url text NOT NULL DEFAULT '',
+  published_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS comments_record_id_idx ON comments (record_id);
+
+CREATE TABLE IF NOT EXISTS pub_tombstones (
+  id int PRIMARY KEY,
+  owner text NOT NULL,
+  deleted_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS pub_deliveries (
+  id serial PRIMARY KEY,
+  activity_id text NOT NULL,
+  sender text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+  inbox text NOT NULL,
+  body text NOT NULL,
+  attempts int NOT NULL DEFAULT 0,
+  next_attempt_at timestamp NOT NULL DEFAULT now(),
+  last_error text NOT NULL DEFAULT '',
+  dead boolean NOT NULL DEFAULT false,
+  created_at timestamp NOT NULL DEFAULT now(),
+
+  UNIQUE (activity_id, inbox)
+);
+
+CREATE INDEX IF NOT EXISTS pub_deliveries_next_attempt_at_idx
+  ON pub_deliveries (next_attempt_at) WHERE NOT dead;
+
+CREATE TABLE IF NOT EXISTS mirrors (
+  id serial PRIMARY KEY,
+  host text NOT NULL,
+  owner text NOT NULL,
+  name text NOT NULL DEFAULT '',
+  last_sync_at timestamp,
+  last_error text NOT NULL DEFAULT '',
+
+  UNIQUE (host, owner, name)
+);
+
+CREATE TABLE IF NOT EXISTS mirrored_records (
+  host text NOT NULL,
+  owner text NOT NULL,
+  name text NOT NULL,
+  cid text NOT NULL,
+  note text NOT NULL DEFAULT '',
+  body text NOT NULL DEFAULT '',
+  raw_history text NOT NULL DEFAULT '',
+  synced_at timestamp NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (host, owner, name)
+);
+`,
+		Down: `
+DROP TABLE mirrored_records;
+DROP TABLE mirrors;
+DROP TABLE pub_deliveries;
+DROP TABLE pub_tombstones;
+DROP TABLE comments;
+DROP TABLE pub_shares;
+DROP TABLE pub_likes;
+DROP TABLE pub_blocks;
+DROP TABLE timeline;
+DROP TABLE pub_following;
+DROP TABLE pub_user_followers;
+DROP TABLE stars;
+DROP TABLE history;
+DROP TABLE head;
+DROP FUNCTION update_history();
+DROP TABLE users;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "move history tracking out of triggers",
+		// history is now written by setRecord so it works on every storage
+		Up: `
+DROP TRIGGER IF EXISTS update_history_ins ON head;
+DROP TRIGGER IF EXISTS update_history_upd ON head;
+DROP FUNCTION IF EXISTS update_history();
+`,
+		Down: `
+CREATE OR REPLACE FUNCTION update_history() RETURNS trigger AS $$
+  DECLARE
+    previous int;
+  BEGIN
+    IF TG_OP = 'UPDATE' THEN
+      SELECT id INTO previous FROM history
+        WHERE record_id = NEW.id
+        ORDER BY id DESC LIMIT 1;
+    END IF;
+
+    INSERT INTO history (record_id, cid, prev)
+      VALUES (NEW.id, NEW.cid, previous);
+
+    RETURN NULL;
+  END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER update_history_ins AFTER INSERT ON head
+  FOR EACH ROW EXECUTE PROCEDURE update_history();
+CREATE TRIGGER update_history_upd AFTER UPDATE OF cid ON head
+  FOR EACH ROW WHEN (NEW.cid != OLD.cid) EXECUTE PROCEDURE update_history();
+`,
+	},
+	{
+		Version: 3,
+		Name:    "email verification",
+		// everybody registered before this is considered verified
+		Up: `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at timestamp NOT NULL DEFAULT now();
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified_at timestamp;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verification_token text NOT NULL DEFAULT '';
+UPDATE users SET verified_at = now();
+`,
+		Down: `
+ALTER TABLE users DROP COLUMN verification_token;
+ALTER TABLE users DROP COLUMN verified_at;
+ALTER TABLE users DROP COLUMN created_at;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "moderation",
+		Up: `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_at timestamp;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspension_reason text NOT NULL DEFAULT '';
+
+ALTER TABLE head ADD COLUMN IF NOT EXISTS state text NOT NULL DEFAULT 'visible'
+  CHECK (state IN ('visible', 'hidden', 'taken_down'));
+ALTER TABLE head ADD COLUMN IF NOT EXISTS state_reason text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS audit_log (
+  id serial PRIMARY KEY,
+  admin text NOT NULL,
+  action text NOT NULL,
+  target text NOT NULL,
+  reason text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS instance_blocks (
+  domain text PRIMARY KEY,
+  reason text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT now()
+);
+`,
+		Down: `
+DROP TABLE instance_blocks;
+DROP TABLE audit_log;
+ALTER TABLE head DROP COLUMN state_reason;
+ALTER TABLE head DROP COLUMN state;
+ALTER TABLE users DROP COLUMN suspension_reason;
+ALTER TABLE users DROP COLUMN suspended_at;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "reports",
+		Up: `
+CREATE TABLE IF NOT EXISTS reports (
+  id serial PRIMARY KEY,
+  owner text NOT NULL,
+  name text NOT NULL,
+  cid text NOT NULL DEFAULT '',
+  category text NOT NULL,
+  description text NOT NULL DEFAULT '',
+  contact text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT now(),
+  resolved_at timestamp,
+  resolved_by text NOT NULL DEFAULT '',
+  resolution text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS reports_open ON reports (created_at) WHERE resolved_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS denied_cids (
+  cid text PRIMARY KEY,
+  reason text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT now()
+);
+INSERT INTO denied_cids (cid, reason)
+SELECT cid, state_reason FROM head WHERE state = 'taken_down'
+ON CONFLICT (cid) DO NOTHING;
+`,
+		Down: `
+DROP TABLE denied_cids;
+DROP TABLE reports;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "aliases",
+		// stars follow records when they are renamed
+		Up: `
+ALTER TABLE stars DROP CONSTRAINT stars_target_owner_target_name_fkey;
+ALTER TABLE stars ADD CONSTRAINT stars_target_owner_target_name_fkey
+  FOREIGN KEY (target_owner, target_name) REFERENCES head (owner, name)
+  ON UPDATE CASCADE;
+
+CREATE TABLE IF NOT EXISTS aliases (
+  owner text NOT NULL,
+  name text NOT NULL,
+  record_id int NOT NULL REFERENCES head (id) ON DELETE CASCADE,
+  created_at timestamp NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (owner, name),
+  CONSTRAINT check_alias_size CHECK (character_length(name) <= 50)
+);
+CREATE INDEX IF NOT EXISTS aliases_record_id_idx ON aliases (record_id);
+`,
+		Down: `
+DROP TABLE aliases;
+ALTER TABLE stars DROP CONSTRAINT stars_target_owner_target_name_fkey;
+ALTER TABLE stars ADD CONSTRAINT stars_target_owner_target_name_fkey
+  FOREIGN KEY (target_owner, target_name) REFERENCES head (owner, name);
+`,
+	},
+	{
+		Version: 7,
+		Name:    "transfers",
+		Up: `
+CREATE TABLE IF NOT EXISTS transfers (
+  record_id int PRIMARY KEY REFERENCES head (id) ON DELETE CASCADE,
+  recipient text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+  created_at timestamp NOT NULL DEFAULT now()
+);
+`,
+		Down: `
+DROP TABLE transfers;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "takedown denials",
+		// a cid can be denied by an admin and by each record taken down
+		// with it, restoring a record only lifts its own denial. record_id
+		// is 0 for denials added by hand.
+		Up: `
+ALTER TABLE denied_cids ADD COLUMN IF NOT EXISTS record_id int NOT NULL DEFAULT 0;
+UPDATE denied_cids SET record_id = head.id
+FROM head
+WHERE head.cid = denied_cids.cid AND head.state = 'taken_down'
+  AND denied_cids.reason LIKE head.owner || '/' || head.name || ': %';
+ALTER TABLE denied_cids DROP CONSTRAINT denied_cids_pkey;
+ALTER TABLE denied_cids ADD PRIMARY KEY (cid, record_id);
+`,
+		Down: `
+DELETE FROM denied_cids a USING denied_cids b
+WHERE a.cid = b.cid AND a.record_id > b.record_id;
+ALTER TABLE denied_cids DROP CONSTRAINT denied_cids_pkey;
+ALTER TABLE denied_cids ADD PRIMARY KEY (cid);
+ALTER TABLE denied_cids DROP COLUMN record_id;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "unresolved deliveries",
+		// deliveries to followers whose inbox we don't know yet hold the
+		// follower in inbox, it is resolved by the delivery worker.
+		Up: `
+ALTER TABLE pub_deliveries ADD COLUMN IF NOT EXISTS unresolved boolean NOT NULL DEFAULT false;
+`,
+		Down: `
+ALTER TABLE pub_deliveries DROP COLUMN unresolved;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "note authors",
+		// notes already federated stay attributed to whoever published them
+		// when a record is transferred. empty means the record owner.
+		Up: `
+ALTER TABLE history ADD COLUMN IF NOT EXISTS author text NOT NULL DEFAULT '';
+`,
+		Down: `
+ALTER TABLE history DROP COLUMN author;
+`,
+	},
+	{
+		Version: 11,
+		Name:    "deleted actors",
+		// deleted users keep signing the Delete of their actor until it is
+		// delivered, so deliveries outlive their sender.
+		Up: `
+CREATE TABLE IF NOT EXISTS pub_deleted_actors (
+  name text PRIMARY KEY,
+  actor_sk text NOT NULL,
+  deleted_at timestamp NOT NULL DEFAULT now()
+);
+ALTER TABLE pub_deliveries DROP CONSTRAINT IF EXISTS pub_deliveries_sender_fkey;
+`,
+		Down: `
+DELETE FROM pub_deliveries WHERE sender NOT IN (SELECT name FROM users);
+ALTER TABLE pub_deliveries ADD CONSTRAINT pub_deliveries_sender_fkey
+  FOREIGN KEY (sender) REFERENCES users (name) ON DELETE CASCADE;
+DROP TABLE pub_deleted_actors;
+`,
+	},
+	{
+		Version: 12,
+		Name:    "anchored name checks",
+		// the old checks matched any name with one valid character in it.
+		// rows already there aren't checked until they are changed.
+		Up: `
+ALTER TABLE head DROP CONSTRAINT check_owner;
+ALTER TABLE head DROP CONSTRAINT check_name;
+ALTER TABLE head ADD CONSTRAINT check_owner CHECK (owner ~ '^[\w.-]+$') NOT VALID;
+ALTER TABLE head ADD CONSTRAINT check_name CHECK (name ~ '^[\w.-]+$') NOT VALID;
+`,
+		Down: `
+ALTER TABLE head DROP CONSTRAINT check_owner;
+ALTER TABLE head DROP CONSTRAINT check_name;
+ALTER TABLE head ADD CONSTRAINT check_owner CHECK (owner ~ '[\w\d.-]+');
+ALTER TABLE head ADD CONSTRAINT check_name CHECK (name ~ '[\w\d.-]+');
+`,
+	},
+}
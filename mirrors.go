@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/lib/pq"
+)
+
+type Mirror struct {
+	Id         int            `json:"id" db:"id"`
+	Host       string         `json:"host" db:"host"`
+	Owner      string         `json:"owner" db:"owner"`
+	Name       string         `json:"name,omitempty" db:"name"`
+	LastSyncAt sql.NullString `json:"-" db:"last_sync_at"`
+	LastSync   string         `json:"last_sync_at,omitempty"`
+	LastError  string         `json:"last_error,omitempty" db:"last_error"`
+}
+
+type Provenance struct {
+	Host     string `json:"host"`
+	URL      string `json:"url"`
+	SyncedAt string `json:"synced_at"`
+}
+
+var mirrorSource = regexp.MustCompile(
+	`^([\w-]+(?:\.[\w-]+)+(?::\d+)?)/([\d\w-]+)(?:/([\d\w-.]+))?/?$`)
+
+// pubUserRecords lists all records of owner with their histories so other
+// gravity servers can mirror them.
+func (s *Server) pubUserRecords(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+
+	entries := make([]Entry, 0)
+	err := s.pg.SelectContext(r.Context(), &entries, `
+        SELECT
+          owner, name, cid, note, body,
+          (
+            SELECT array_to_string(array_agg(cid || '|' || set_at ORDER BY id DESC), '~')
+            FROM history
+            WHERE record_id = head.id
+          ) AS raw_history
+        FROM head
+        WHERE owner = $1 AND state = 'visible'
+        ORDER BY name
+    `, owner)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	// records pointing to denied cids aren't mirrored
+	visible := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if s.denylist.Contains(entry.CID) {
+			continue
+		}
+		if entry.RawHistory.Valid {
+			entry.History = parseRawHistory(entry.RawHistory.String)
+		}
+		visible = append(visible, entry)
+	}
+	entries = visible
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *Server) getMirroredName(w http.ResponseWriter, r *http.Request) {
+	host := mux.Vars(r)["host"]
+	owner := mux.Vars(r)["owner"]
+	name := mux.Vars(r)["name"]
+
+	var entry struct {
+		Entry
+		SyncedAt string `db:"synced_at"`
+	}
+	err := s.pg.GetContext(r.Context(), &entry, `
+        SELECT owner, name, cid, note, body, raw_history, synced_at
+        FROM mirrored_records
+        WHERE host = $1 AND owner = $2 AND name = $3
+    `, host, owner, name)
+	if err == sql.ErrNoRows || s.denylist.Contains(entry.CID) {
+		json.NewEncoder(w).Encode(nil)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("host", host).Str("owner", owner).Str("name", name).
+			Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	res := entry.Entry
+	if r.URL.Query().Get("full") == "1" {
+		if res.RawHistory.Valid && res.RawHistory.String != "" {
+			res.History = parseRawHistory(res.RawHistory.String)
+		}
+	} else {
+		res.Body = ""
+	}
+	res.Provenance = &Provenance{
+		Host:     host,
+		URL:      "https://" + host + "/" + owner + "/" + name,
+		SyncedAt: entry.SyncedAt,
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) listMirrors(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Unauthorized.", 401)
+		return
+	}
+
+	mirrors := make([]Mirror, 0)
+	err := s.pg.SelectContext(r.Context(), &mirrors, `
+        SELECT id, host, owner, name, last_sync_at, last_error
+        FROM mirrors
+        ORDER BY host, owner, name
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("error fetching mirrors")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+	for i := range mirrors {
+		mirrors[i].LastSync = mirrors[i].LastSyncAt.String
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mirrors)
+}
+
+// addMirror subscribes to all records of a remote owner (host/owner) or to
+// a single record (host/owner/name).
+func (s *Server) addMirror(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Unauthorized.", 401)
+		return
+	}
+
+	var data struct {
+		Source string `json:"source"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, "Invalid JSON.", 400)
+		return
+	}
+
+	match := mirrorSource.FindStringSubmatch(data.Source)
+	if match == nil {
+		http.Error(w, "Source must be host/owner or host/owner/name.", 400)
+		return
+	}
+	if u, err := url.Parse(s.ServiceURL); err == nil && u.Host == match[1] {
+		http.Error(w, "Can't mirror records from ourselves.", 400)
+		return
+	}
+
+	var m Mirror
+	err = s.pg.GetContext(r.Context(), &m, `
+        INSERT INTO mirrors (host, owner, name)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (host, owner, name) DO UPDATE SET host = $1
+        RETURNING id, host, owner, name
+    `, match[1], match[2], match[3])
+	if err != nil {
+		log.Warn().Err(err).Str("source", data.Source).Msg("error adding mirror")
+		http.Error(w, "Error adding mirror.", 500)
+		return
+	}
+
+	s.inBackground(func() { s.syncMirror(m) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+func (s *Server) delMirror(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !s.isAdmin(r) {
+		http.Error(w, "Unauthorized.", 401)
+		return
+	}
+
+	var m Mirror
+	err := s.pg.GetContext(r.Context(), &m, `
+        DELETE FROM mirrors WHERE id = $1
+        RETURNING id, host, owner, name
+    `, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Mirror not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("error removing mirror")
+		http.Error(w, "Error removing mirror.", 500)
+		return
+	}
+
+	// copies not covered by any other mirror are gone too
+	_, err = s.pg.ExecContext(r.Context(), `
+        DELETE FROM mirrored_records
+        WHERE host = $1 AND owner = $2 AND ($3 = '' OR name = $3)
+          AND NOT EXISTS (
+            SELECT 1 FROM mirrors
+            WHERE mirrors.host = $1 AND mirrors.owner = $2
+              AND (mirrors.name = '' OR mirrors.name = mirrored_records.name)
+          )
+    `, m.Host, m.Owner, m.Name)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("error removing mirrored records")
+		http.Error(w, "Error removing mirror.", 500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func (s *Server) mirrorWorker(ctx context.Context) {
+	for {
+		var mirrors []Mirror
+		err := s.pg.Select(&mirrors, `SELECT id, host, owner, name FROM mirrors`)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to fetch mirrors")
+		}
+
+		for _, m := range mirrors {
+			s.syncMirror(m)
+		}
+
+		select {
+		case <-time.After(s.MirrorInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncMirror makes our copies of the records covered by m equal to what
+// is on the remote gravity right now.
+func (s *Server) syncMirror(m Mirror) {
+	err := s.fetchMirror(m)
+
+	errMsg := ""
+	if err != nil {
+		log.Warn().Err(err).Str("host", m.Host).Str("owner", m.Owner).
+			Str("name", m.Name).Msg("failed to sync mirror")
+		errMsg = err.Error()
+	}
+
+	_, err = s.pg.Exec(`
+        UPDATE mirrors SET last_sync_at = now(), last_error = $2
+        WHERE id = $1
+    `, m.Id, errMsg)
+	if err != nil {
+		log.Warn().Err(err).Int("id", m.Id).Msg("failed to update mirror")
+	}
+}
+
+func (s *Server) fetchMirror(m Mirror) error {
+	resp, err := pubClient.Get("https://" + m.Host + "/pub/user/" + m.Owner + "/records")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fetchError{url: resp.Request.URL.String(), status: resp.StatusCode}
+	}
+
+	var entries []Entry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return err
+	}
+
+	txn, err := s.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Owner != m.Owner || (m.Name != "" && entry.Name != m.Name) {
+			continue
+		}
+		if _, err := gocid.Parse(entry.CID); err != nil {
+			log.Info().Str("host", m.Host).Str("owner", m.Owner).Str("name", entry.Name).
+				Str("cid", entry.CID).Msg("skipping mirrored record with an invalid cid")
+			continue
+		}
+		names = append(names, entry.Name)
+
+		// these are joined with | and ~ and read back by parseRawHistory
+		rawHistory := make([]string, 0, len(entry.History))
+		for _, h := range entry.History {
+			if _, err := gocid.Parse(h.CID); err != nil ||
+				strings.ContainsAny(h.Date, "|~") {
+				continue
+			}
+			rawHistory = append(rawHistory, h.CID+"|"+h.Date)
+		}
+
+		_, err = txn.Exec(`
+            INSERT INTO mirrored_records
+              (host, owner, name, cid, note, body, raw_history, synced_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+            ON CONFLICT (host, owner, name) DO UPDATE SET
+              cid = $4, note = $5, body = $6, raw_history = $7, synced_at = now()
+        `, m.Host, m.Owner, entry.Name, entry.CID, entry.Note, entry.Body,
+			strings.Join(rawHistory, "~"))
+		if err != nil {
+			return err
+		}
+	}
+
+	// records that don't exist anymore on the other side
+	_, err = txn.Exec(`
+        DELETE FROM mirrored_records
+        WHERE host = $1 AND owner = $2 AND ($3 = '' OR name = $3)
+          AND name != ALL ($4)
+    `, m.Host, m.Owner, m.Name, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	err = txn.Commit()
+	if err == nil && m.Name != "" && len(names) == 0 {
+		err = errors.New(m.Name + " not found on " + m.Host)
+	}
+	return err
+}
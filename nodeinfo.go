@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const softwareName = "gravity"
+
+var softwareVersion = "2.0.0"
+
+type NodeInfoLinks struct {
+	Links []WebfingerLink `json:"links"`
+}
+
+type NodeInfo struct {
+	Version           string           `json:"version"`
+	Software          NodeInfoSoftware `json:"software"`
+	Protocols         []string         `json:"protocols"`
+	Services          NodeInfoServices `json:"services"`
+	OpenRegistrations bool             `json:"openRegistrations"`
+	Usage             NodeInfoUsage    `json:"usage"`
+	Metadata          NodeInfoMetadata `json:"metadata"`
+}
+
+type NodeInfoSoftware struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type NodeInfoServices struct {
+	Inbound  []string `json:"inbound"`
+	Outbound []string `json:"outbound"`
+}
+
+type NodeInfoUsage struct {
+	Users struct {
+		Total          int `json:"total" db:"total"`
+		ActiveMonth    int `json:"activeMonth" db:"active_month"`
+		ActiveHalfyear int `json:"activeHalfyear" db:"active_halfyear"`
+	} `json:"users"`
+	LocalPosts int `json:"localPosts"`
+}
+
+type NodeInfoMetadata struct {
+	NodeName string `json:"nodeName"`
+	Records  int    `json:"records"`
+}
+
+type Instance struct {
+	Name              string         `json:"name"`
+	URL               string         `json:"url"`
+	Icon              string         `json:"icon"`
+	Gateway           string         `json:"gateway"`
+	Software          string         `json:"software"`
+	Version           string         `json:"version"`
+	OpenRegistrations bool           `json:"open_registrations"`
+	Limits            InstanceLimits `json:"limits"`
+	Features          []string       `json:"features"`
+}
+
+type InstanceLimits struct {
+	OwnerLength int `json:"owner_length"`
+	NameLength  int `json:"name_length"`
+	NoteLength  int `json:"note_length"`
+}
+
+func (s *Server) nodeinfoLinks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NodeInfoLinks{
+		Links: []WebfingerLink{
+			{
+				Rel:  "http://nodeinfo.diaspora.software/ns/schema/2.0",
+				Href: s.ServiceURL + "/nodeinfo/2.0",
+			},
+		},
+	})
+}
+
+func (s *Server) nodeinfo(w http.ResponseWriter, r *http.Request) {
+	info := NodeInfo{
+		Version: "2.0",
+		Software: NodeInfoSoftware{
+			Name:    softwareName,
+			Version: softwareVersion,
+		},
+		Protocols: []string{"activitypub"},
+		Services: NodeInfoServices{
+			Inbound:  []string{},
+			Outbound: []string{"atom1.0", "rss2.0"},
+		},
+		OpenRegistrations: s.OpenRegistrations,
+		Metadata: NodeInfoMetadata{
+			NodeName: s.ServiceName,
+		},
+	}
+
+	// users are active if they have set some record recently
+	err := s.pg.GetContext(r.Context(), &info.Usage.Users, `
+        SELECT
+          count(*) AS total,
+          count(*) FILTER (WHERE last_update > now() - interval '1 month') AS active_month,
+          count(*) FILTER (WHERE last_update > now() - interval '6 months') AS active_halfyear
+        FROM (
+          SELECT max(updated_at) AS last_update
+          FROM users
+          LEFT OUTER JOIN head ON head.owner = users.name
+          GROUP BY users.name
+        ) AS u
+    `)
+	if err == nil {
+		err = s.pg.GetContext(r.Context(), &info.Usage.LocalPosts, `SELECT count(*) FROM history`)
+	}
+	if err == nil {
+		err = s.pg.GetContext(r.Context(), &info.Metadata.Records, `SELECT count(*) FROM head`)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("error fetching nodeinfo stats")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type",
+		`application/json; profile="http://nodeinfo.diaspora.software/ns/schema/2.0#"`)
+	json.NewEncoder(w).Encode(info)
+}
+
+func (s *Server) instance(w http.ResponseWriter, r *http.Request) {
+	features := []string{}
+	if s.pg != nil {
+		features = []string{
+			"activitypub", "webfinger", "nodeinfo", "feeds",
+			"timeline", "mirrors",
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Instance{
+		Name:              s.ServiceName,
+		URL:               s.ServiceURL,
+		Icon:              s.ServiceURL + "/icon.svg",
+		Gateway:           s.IPFSGateway,
+		Software:          softwareName,
+		Version:           softwareVersion,
+		OpenRegistrations: s.OpenRegistrations,
+		// these are the same as the constraints on the head table
+		Limits: InstanceLimits{
+			OwnerLength: 35,
+			NameLength:  50,
+			NoteLength:  280,
+		},
+		Features: features,
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fiatjaf/litepub"
+)
+
+// PubNote is a richer note than litepub's, with everything Mastodon and
+// Pleroma need to render records nicely.
+type PubNote struct {
+	litepub.Base
+	Published    string          `json:"published"`
+	AttributedTo string          `json:"attributedTo"`
+	Content      string          `json:"content"`
+	URL          string          `json:"url"`
+	To           []string        `json:"to"`
+	Cc           []string        `json:"cc"`
+	Attachment   []PubAttachment `json:"attachment"`
+	Tag          []PubTag        `json:"tag"`
+}
+
+type PubAttachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	Name      string `json:"name,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Href      string `json:"href,omitempty"`
+}
+
+type PubTag struct {
+	Type string `json:"type"`
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+const noteExcerptSize = 280
+
+var tagChars = regexp.MustCompile(`[^\w-]`)
+
+var sniffClient = &http.Client{Timeout: 5 * time.Second}
+
+func (s *Server) makeNote(dbnote DBNote) PubNote {
+	url := s.ServiceURL + "/" + dbnote.Owner + "/" + dbnote.Name
+	actor := s.ServiceURL + "/pub/user/" + dbnote.author()
+	gatewayURL := s.IPFSGateway + "/ipfs/" + dbnote.CID
+
+	content := fmt.Sprintf(
+		"<p><a href=\"%s\">%s/%s</a>: <a href=\"%s\">%s</a></p>",
+		html.EscapeString(url), html.EscapeString(dbnote.Owner), html.EscapeString(dbnote.Name),
+		html.EscapeString(gatewayURL), html.EscapeString(dbnote.CID))
+	if dbnote.Note != "" {
+		content += "<p>" + html.EscapeString(dbnote.Note) + "</p>"
+	}
+	if dbnote.Body != "" {
+		content += "<p>" + html.EscapeString(excerpt(dbnote.Body, noteExcerptSize)) + "</p>"
+	}
+
+	tags := make([]PubTag, len(dbnote.Tags))
+	if len(dbnote.Tags) > 0 {
+		links := make([]string, len(dbnote.Tags))
+		for i, tag := range dbnote.Tags {
+			tags[i] = PubTag{
+				Type: "Hashtag",
+				Href: s.ServiceURL + "/?tag=" + tag,
+				Name: "#" + tag,
+			}
+			links[i] = fmt.Sprintf(
+				"<a href=\"%s\" class=\"mention hashtag\" rel=\"tag\">#<span>%s</span></a>",
+				tags[i].Href, tag)
+		}
+		content += "<p>" + strings.Join(links, " ") + "</p>"
+	}
+
+	// images and videos are shown inline, everything else is a link
+	var attachment PubAttachment
+	if strings.HasPrefix(dbnote.MediaType, "image/") ||
+		strings.HasPrefix(dbnote.MediaType, "video/") {
+		attachment = PubAttachment{
+			Type:      "Document",
+			MediaType: dbnote.MediaType,
+			Name:      dbnote.Owner + "/" + dbnote.Name,
+			URL:       gatewayURL,
+		}
+	} else {
+		attachment = PubAttachment{
+			Type:      "Link",
+			MediaType: dbnote.MediaType,
+			Name:      dbnote.CID,
+			Href:      gatewayURL,
+		}
+	}
+
+	return PubNote{
+		Base: litepub.Base{
+			Id:   s.ServiceURL + "/pub/note/" + dbnote.Id,
+			Type: "Note",
+		},
+		Published:    dbnote.SetAt,
+		AttributedTo: actor,
+		Content:      content,
+		URL:          url,
+		To:           []string{pubPublic},
+		Cc:           []string{actor + "/followers"},
+		Attachment:   []PubAttachment{attachment},
+		Tag:          tags,
+	}
+}
+
+func (s *Server) makeCreate(dbnote DBNote) Activity {
+	note := s.makeNote(dbnote)
+	return Activity{
+		Base: litepub.Base{
+			Id:   s.ServiceURL + "/pub/create/" + dbnote.Id,
+			Type: "Create",
+		},
+		Actor:     note.AttributedTo,
+		Published: note.Published,
+		To:        pubPublic,
+		Cc:        note.Cc,
+		Object:    note,
+	}
+}
+
+// sniffMediaType looks at the first bytes of an IPFS object to guess what
+// it is. returns an empty string if we can't tell.
+func (s *Server) sniffMediaType(cid string) string {
+	req, err := http.NewRequest("GET", s.IPFSGateway+"/ipfs/"+cid, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("Range", "bytes=0-511")
+
+	resp, err := sniffClient.Do(req)
+	if err != nil {
+		log.Info().Err(err).Str("cid", cid).Msg("couldn't sniff media type")
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return ""
+	}
+
+	head, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	mediaType := http.DetectContentType(head)
+
+	// directories and unknown stuff are just links
+	if mediaType == "application/octet-stream" || strings.HasPrefix(mediaType, "text/html") {
+		return ""
+	}
+	return strings.Split(mediaType, ";")[0]
+}
+
+// normalizeTags turns a list of things like "#IPFS" or "open data" into
+// hashtags we can use.
+func normalizeTags(raw []interface{}) []string {
+	tags := make([]string, 0, len(raw))
+	seen := make(map[string]bool)
+	for _, t := range raw {
+		str, _ := t.(string)
+		tag := strings.ToLower(tagChars.ReplaceAllString(strings.TrimPrefix(str, "#"), ""))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func excerpt(text string, size int) string {
+	if utf8.RuneCountInString(text) <= size {
+		return text
+	}
+	return string([]rune(text)[:size-1]) + "…"
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMakeNoteContent(t *testing.T) {
+	s := &Server{Settings: Settings{ServiceURL: "https://gravity.test", IPFSGateway: "https://ipfs.io"}}
+	note := s.makeNote(DBNote{
+		Owner: "bob",
+		Name:  `x"><script>alert(1)</script>`,
+		CID:   testCID1,
+		Note:  "<b>note</b>",
+	})
+
+	for _, bad := range []string{"<script", `"><`, "<b>"} {
+		if strings.Contains(note.Content, bad) {
+			t.Errorf("%s wasn't escaped in %s", bad, note.Content)
+		}
+	}
+	if !strings.Contains(note.Content, "bob/x&#34;&gt;&lt;script&gt;") {
+		t.Errorf("name is missing from %s", note.Content)
+	}
+}
@@ -6,30 +6,86 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/fiatjaf/litepub"
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 	"github.com/tidwall/gjson"
 )
 
+var pubClient = &http.Client{Timeout: 15 * time.Second}
+
+const pubPublic = "https://www.w3.org/ns/activitystreams#Public"
+
+// Activity is for the activity types litepub doesn't have, like Update and
+// Delete.
+type Activity struct {
+	litepub.Base
+	Actor     string      `json:"actor"`
+	Published string      `json:"published,omitempty"`
+	To        string      `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Object    interface{} `json:"object"`
+}
+
+type Tombstone struct {
+	litepub.Base
+	FormerType string `json:"formerType"`
+	Deleted    string `json:"deleted"`
+}
+
 type DBNote struct {
-	Id    string `db:"id"`
-	Owner string `db:"owner"`
-	Name  string `db:"name"`
-	SetAt string `db:"set_at"`
-	CID   string `db:"cid"`
+	Id        string         `db:"id"`
+	Owner     string         `db:"owner"`
+	Name      string         `db:"name"`
+	SetAt     string         `db:"set_at"`
+	CID       string         `db:"cid"`
+	Note      string         `db:"note"`
+	Body      string         `db:"body"`
+	Tags      pq.StringArray `db:"tags"`
+	MediaType string         `db:"media_type"`
+	Author    string         `db:"author"` // when not the owner, after a transfer
+}
+
+// author is who published this version of the record.
+func (dbnote DBNote) author() string {
+	if dbnote.Author != "" {
+		return dbnote.Author
+	}
+	return dbnote.Owner
 }
 
-func pubUserActor(w http.ResponseWriter, r *http.Request) {
+// PubActor adds the collections litepub doesn't know about.
+type PubActor struct {
+	litepub.Actor
+	Following string `json:"following"`
+	Featured  string `json:"featured"`
+	Liked     string `json:"liked"`
+}
+
+func (s *Server) pubUserActor(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 
-	var exists int
-	err := pg.Get(&exists, `SELECT count(*) FROM users WHERE name = $1`, owner)
-	if err != nil {
+	var manuallyApprovesFollowers bool
+	err := s.pg.GetContext(r.Context(), &manuallyApprovesFollowers, `
+        SELECT manually_approves_followers FROM users WHERE name = $1
+    `, owner)
+	if err == sql.ErrNoRows {
+		s.pubActorTombstone(w, owner)
+		return
+	}
+
+	publicKeyPEM, err := s.pubUserPublicKeyPEM(owner)
+	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", 404)
 		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error loading actor key")
+		http.Error(w, "Error fetching data.", 500)
+		return
 	}
 
 	image := litepub.ActorImage{
@@ -47,7 +103,7 @@ func pubUserActor(w http.ResponseWriter, r *http.Request) {
 		Name:                      owner,
 		PreferredUsername:         owner,
 		Followers:                 s.ServiceURL + "/pub/user/" + owner + "/followers",
-		ManuallyApprovesFollowers: false,
+		ManuallyApprovesFollowers: manuallyApprovesFollowers,
 		Image:  image,
 		Icon:   image,
 		URL:    s.ServiceURL + "/" + owner,
@@ -55,68 +111,68 @@ func pubUserActor(w http.ResponseWriter, r *http.Request) {
 		Outbox: s.ServiceURL + "/pub/user/" + owner + "/outbox",
 
 		PublicKey: litepub.PublicKey{
-			Id:           s.ServiceURL + "/pub/user/" + owner + "#main-key",
+			Id:           s.pubUserKeyId(owner),
 			Owner:        s.ServiceURL + "/pub/user/" + owner,
-			PublicKeyPEM: s.PublicKeyPEM,
+			PublicKeyPEM: publicKeyPEM,
 		},
 	}
 
 	w.Header().Set("Content-Type", "application/activity+json")
-	json.NewEncoder(w).Encode(actor)
+	json.NewEncoder(w).Encode(PubActor{
+		Actor:     actor,
+		Following: s.ServiceURL + "/pub/user/" + owner + "/following",
+		Featured:  s.ServiceURL + "/pub/user/" + owner + "/featured",
+		Liked:     s.ServiceURL + "/pub/user/" + owner + "/liked",
+	})
 }
 
-func pubUserFollowers(w http.ResponseWriter, r *http.Request) {
+func (s *Server) pubUserFollowers(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 
-	followers := make([]string, 0)
-	pg.Select(&followers, `
-        SELECT follower
-        FROM pub_user_followers
-        WHERE target = $1
+	var total int
+	err := s.pg.GetContext(r.Context(), &total, `
+        SELECT count(*) FROM pub_user_followers
+        WHERE target = $1 AND NOT pending
     `, owner)
-
-	page := litepub.OrderedCollectionPage{
-		Base: litepub.Base{
-			Type: "OrderedCollectionPage",
-			Id:   s.ServiceURL + "/pub/user/" + owner + "/followers?page=1",
-		},
-		PartOf:       s.ServiceURL + "/pub/user/" + owner + "/followers",
-		TotalItems:   len(followers),
-		OrderedItems: followers,
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error counting followers")
+		http.Error(w, "Error fetching data.", 500)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/activity+json")
-	if r.URL.Query().Get("page") != "" {
-		page.Base.Context = litepub.CONTEXT
-		json.NewEncoder(w).Encode(page)
-	} else {
-		collection := litepub.OrderedCollection{
-			Base: litepub.Base{
-				Context: litepub.CONTEXT,
-				Type:    "OrderedCollection",
-				Id:      s.ServiceURL + "/pub/user/" + owner + "/followers",
-			},
-			First:      page,
-			TotalItems: len(followers),
-		}
-		json.NewEncoder(w).Encode(collection)
-	}
+	pubServeCollection(w, r, s.ServiceURL+"/pub/user/"+owner+"/followers", total,
+		func(limit, offset int) (interface{}, error) {
+			followers := make([]string, 0)
+			err := s.pg.SelectContext(r.Context(), &followers, `
+                SELECT follower
+                FROM pub_user_followers
+                WHERE target = $1 AND NOT pending
+                ORDER BY follower
+                LIMIT $2 OFFSET $3
+            `, owner, limit, offset)
+			return followers, err
+		})
 }
 
-func pubOutbox(w http.ResponseWriter, r *http.Request) {
+func (s *Server) pubOutbox(w http.ResponseWriter, r *http.Request) {
 	owner := mux.Vars(r)["owner"]
 
 	var dbnotes []DBNote
-	err := pg.Select(&dbnotes, `
+	err := s.pg.SelectContext(r.Context(), &dbnotes, `
         SELECT
             history.id::text AS id,
             owner,
             name,
             set_at,
-            history.cid
+            history.cid,
+            note,
+            body,
+            tags,
+            media_type,
+            author
         FROM history
         INNER JOIN head ON history.record_id = head.id
-        WHERE owner = $1
+        WHERE (author = $1 OR (author = '' AND owner = $1)) AND state = 'visible'
         ORDER BY history.set_at DESC
     `, owner)
 	if err == sql.ErrNoRows {
@@ -126,12 +182,11 @@ func pubOutbox(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to fetch activities.", 500)
 		return
 	}
+	dbnotes = s.visibleNotes(dbnotes)
 
-	notes := make([]litepub.Note, len(dbnotes))
-	creates := make([]litepub.Create, len(dbnotes))
+	creates := make([]Activity, len(dbnotes))
 	for i, dbnote := range dbnotes {
-		notes[i] = makeNote(dbnote)
-		creates[i] = pub.WrapCreate(notes[i], s.ServiceURL+"/pub/create/"+dbnote.Id)
+		creates[i] = s.makeCreate(dbnote)
 	}
 
 	page := litepub.OrderedCollectionPage{
@@ -162,98 +217,179 @@ func pubOutbox(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func pubNote(w http.ResponseWriter, r *http.Request) {
+func (s *Server) pubNote(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	note, err := fetchNote(id)
-	if err != nil {
+	dbnote, err := s.fetchDBNote(id)
+	if err == sql.ErrNoRows {
+		s.pubTombstone(w, id, s.ServiceURL+"/pub/note/"+id, "Note")
+		return
+	} else if err != nil || s.denylist.Contains(dbnote.CID) {
 		http.Error(w, "Note not found", 404)
 		return
 	}
+	note := s.makeNote(dbnote)
+	note.Base.Context = litepub.CONTEXT
 
 	w.Header().Set("Content-Type", "application/activity+json")
 	json.NewEncoder(w).Encode(note)
 }
 
-func pubCreate(w http.ResponseWriter, r *http.Request) {
+func (s *Server) pubCreate(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	note, err := fetchNote(id)
-	if err != nil {
+	dbnote, err := s.fetchDBNote(id)
+	if err == sql.ErrNoRows {
+		s.pubTombstone(w, id, s.ServiceURL+"/pub/create/"+id, "Create")
+		return
+	} else if err != nil || s.denylist.Contains(dbnote.CID) {
 		http.Error(w, "Note not found", 404)
 		return
 	}
-	create := pub.WrapCreate(note, s.ServiceURL+"/pub/create/"+id)
+	create := s.makeCreate(dbnote)
 	create.Base.Context = litepub.CONTEXT
 
 	w.Header().Set("Content-Type", "application/activity+json")
-	json.NewEncoder(w).Encode(note)
+	json.NewEncoder(w).Encode(create)
+}
+
+// pubActorTombstone answers for users that were deleted.
+func (s *Server) pubActorTombstone(w http.ResponseWriter, owner string) {
+	var deletedAt string
+	err := s.pg.Get(&deletedAt, `
+        SELECT deleted_at FROM pub_deleted_actors WHERE name = $1
+    `, owner)
+	if err != nil {
+		http.Error(w, "User not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	w.WriteHeader(410)
+	json.NewEncoder(w).Encode(Tombstone{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Id:      s.ServiceURL + "/pub/user/" + owner,
+			Type:    "Tombstone",
+		},
+		FormerType: "Person",
+		Deleted:    deletedAt,
+	})
+}
+
+// pubTombstone answers for notes whose records were deleted.
+func (s *Server) pubTombstone(w http.ResponseWriter, id, url, formerType string) {
+	var deletedAt string
+	err := s.pg.Get(&deletedAt, `
+        SELECT deleted_at FROM pub_tombstones WHERE id = $1
+    `, id)
+	if err != nil {
+		http.Error(w, "Note not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	w.WriteHeader(410)
+	json.NewEncoder(w).Encode(Tombstone{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Id:      url,
+			Type:    "Tombstone",
+		},
+		FormerType: formerType,
+		Deleted:    deletedAt,
+	})
 }
 
-func fetchNote(id string) (note litepub.Note, err error) {
-	var dbnote DBNote
-	err = pg.Get(&dbnote, `
+func (s *Server) fetchDBNote(id string) (dbnote DBNote, err error) {
+	err = s.pg.Get(&dbnote, `
         SELECT
             history.id::text AS id,
             owner,
             name,
             set_at,
-            history.cid
+            history.cid,
+            note,
+            body,
+            tags,
+            media_type,
+            author
         FROM history
         INNER JOIN head ON history.record_id = head.id
-        WHERE history.id = $1
-        ORDER BY history.set_at DESC
+        WHERE history.id = $1 AND state = 'visible'
     `, id)
-	if err != nil {
-		return
-	}
-
-	note = makeNote(dbnote)
-	note.Base.Context = litepub.CONTEXT
 	return
 }
 
-func makeNote(dbnote DBNote) litepub.Note {
-	return litepub.Note{
-		Base: litepub.Base{
-			Id:   s.ServiceURL + "/pub/note/" + dbnote.Id,
-			Type: "Note",
-		},
-		Published:    dbnote.SetAt,
-		AttributedTo: s.ServiceURL + "/pub/user/" + dbnote.Owner,
-		Content: fmt.Sprintf(
-			"%s/%s: https://ipfs.io/ipfs/%s",
-			dbnote.Owner, dbnote.Name, dbnote.CID),
-		To: "https://www.w3.org/ns/activitystreams#Public",
-	}
+// fetchLatestDBNote gets the note for the current version of a record.
+func (s *Server) fetchLatestDBNote(owner, name string) (dbnote DBNote, err error) {
+	err = s.pg.Get(&dbnote, `
+        SELECT
+            history.id::text AS id,
+            owner,
+            name,
+            set_at,
+            history.cid,
+            note,
+            body,
+            tags,
+            media_type,
+            author
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE owner = $1 AND name = $2 AND state = 'visible'
+        ORDER BY history.id DESC
+        LIMIT 1
+    `, owner, name)
+	return
 }
 
-func pubInbox(w http.ResponseWriter, r *http.Request) {
-	b, _ := ioutil.ReadAll(r.Body)
+func (s *Server) pubInbox(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Request body too large.", 413)
+		return
+	}
 
 	j := gjson.ParseBytes(b)
 	typ := j.Get("type").String()
+	actor := j.Get("actor").String()
+
+	// nothing from blocked instances, not even fetching their keys
+	if u, err := url.Parse(actor); err == nil && s.pubInstanceBlocked(u.Hostname()) {
+		http.Error(w, "Blocked.", 403)
+		return
+	}
+
+	// make sure this was sent by whoever it says it was
+	signer, err := verifyRequest(r, b)
+	if err != nil {
+		if typ == "Delete" && pubObjectId(j.Get("object")) == actor && actorIsGone(actor) {
+			// a deleted actor's key can't be fetched anymore, but if the
+			// actor is really gone there's nothing to be forged here.
+			signer = actor
+		} else {
+			log.Warn().Err(err).Str("actor", actor).Str("type", typ).
+				Msg("invalid signature on inbox request")
+			http.Error(w, "Invalid signature: "+err.Error(), 401)
+			return
+		}
+	}
+	if signer != actor {
+		log.Warn().Str("actor", actor).Str("signer", signer).Str("type", typ).
+			Msg("activity actor doesn't match the signature")
+		http.Error(w, "Actor doesn't match signature.", 401)
+		return
+	}
+
 	switch typ {
 	case "Follow":
-		actor := j.Get("actor").String()
 		object := j.Get("object").String()
 		parts := strings.Split(object, "/")
 		user_target := parts[len(parts)-1]
 
-		_, err = pg.Exec(`
-            INSERT INTO pub_user_followers (follower, target)
-            VALUES ($1, $2)
-            ON CONFLICT (follower, target) DO NOTHING
-        `, actor, user_target)
-
-		if err != nil && err != sql.ErrNoRows {
-			log.Warn().Err(err).Str("actor", actor).Str("object", object).
-				Msg("error saving Follow")
-			http.Error(w, "Failed to accept Follow.", 500)
-			return
-		}
-
-		url, err := litepub.FetchInbox(actor)
+		url, sharedInbox, err := fetchActorInboxes(actor)
 		if err != nil {
 			log.Warn().Err(err).Str("actor", actor).
 				Msg("didn't found an inbox from the follower")
@@ -261,43 +397,52 @@ func pubInbox(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		accept := litepub.Accept{
-			Base: litepub.Base{
-				Context: litepub.CONTEXT,
-				Type:    "Accept",
-				Id:      s.ServiceURL + "/pub/accept/" + actor + "/" + user_target,
-			},
-			Object: object,
+		followId := j.Get("id").String()
+		if s.pubIsBlocked(user_target, actor) {
+			err = s.pubRespondFollow("Reject", user_target, actor, followId, url)
+			if err != nil {
+				log.Warn().Err(err).Str("actor", actor).Msg("failed to queue Reject")
+			}
+			break
 		}
-		resp, err := pub.SendSigned(
-			s.ServiceURL+"/pub/user/"+actor+"#main-key", url, accept)
 
-		var b []byte
-		if resp != nil && resp.Body != nil {
-			b, _ = ioutil.ReadAll(resp.Body)
-			b, _ = ioutil.ReadAll(resp.Body)
-		}
-		if err != nil {
-			log.Warn().Err(err).Str("body", string(b)).
-				Msg("failed to send Accept")
-			http.Error(w, "Failed to send Accept.", 503)
+		// followers of users that approve them manually start as pending
+		pending, err := s.store.AddFollower(r.Context(), user_target, Follower{
+			Actor:       actor,
+			Inbox:       url,
+			SharedInbox: sharedInbox,
+			FollowId:    followId,
+		})
+
+		if err != nil && err != sql.ErrNoRows {
+			log.Warn().Err(err).Str("actor", actor).Str("object", object).
+				Msg("error saving Follow")
+			http.Error(w, "Failed to accept Follow.", 500)
 			return
 		}
-		log.Print(string(b))
+
+		if !pending {
+			err = s.pubRespondFollow("Accept", user_target, actor, followId, url)
+			if err != nil {
+				log.Warn().Err(err).Str("actor", actor).Msg("failed to queue Accept")
+				http.Error(w, "Failed to send Accept.", 503)
+				return
+			}
+		}
 
 		break
 	case "Undo":
 		switch j.Get("object.type").String() {
 		case "Follow":
-			actor := j.Get("object.actor").String()
+			if j.Get("object.actor").String() != actor {
+				http.Error(w, "Can't undo someone else's Follow.", 401)
+				return
+			}
 			object := j.Get("object.object").String()
 			parts := strings.Split(object, "/")
 			user_target := parts[len(parts)-1]
 
-			_, err = pg.Exec(`
-                DELETE FROM pub_user_followers
-                WHERE follower = $1 AND target = $2
-            `, actor, user_target)
+			err = s.store.RemoveFollower(r.Context(), user_target, actor)
 
 			if err != nil && err != sql.ErrNoRows {
 				log.Warn().Err(err).Str("actor", actor).Str("object", object).
@@ -306,11 +451,99 @@ func pubInbox(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			break
+		case "Like", "Announce":
+			undone := j.Get("object.type").String()
+			if author := j.Get("object.actor"); author.Exists() && author.String() != actor {
+				http.Error(w, "Can't undo someone else's "+undone+".", 401)
+				return
+			}
+
+			err = s.pubUndoInteraction(undone, actor, j.Get("object"))
+			if err != nil && err != sql.ErrNoRows {
+				log.Warn().Err(err).Str("actor", actor).Str("type", undone).
+					Msg("error undoing interaction")
+				http.Error(w, "Failed to accept Undo.", 500)
+				return
+			}
+			break
+		}
+	case "Like", "Announce":
+		err = s.pubSaveInteraction(typ, actor, j)
+		if err == sql.ErrNoRows {
+			// not about something of ours
+			break
+		} else if err != nil {
+			log.Warn().Err(err).Str("actor", actor).Str("type", typ).
+				Msg("error saving interaction")
+			http.Error(w, "Failed to accept "+typ+".", 500)
+			return
+		}
+		break
+	case "Create":
+		note := j.Get("object")
+		if note.Get("type").String() != "Note" {
+			break
+		}
+		if note.Get("attributedTo").String() != actor {
+			http.Error(w, "Note not attributed to actor.", 401)
+			return
+		}
+		if !sameOrigin(note.Get("id").String(), actor) {
+			http.Error(w, "Note not on the actor's server.", 401)
+			return
+		}
+
+		if note.Get("inReplyTo").String() != "" {
+			err = s.pubSaveReply(actor, note)
+			if err != nil && err != sql.ErrNoRows {
+				log.Warn().Err(err).Str("actor", actor).
+					Str("note", note.Get("id").String()).
+					Msg("error saving reply")
+				http.Error(w, "Failed to accept Create.", 500)
+				return
+			}
+		}
+
+		// notes from people our users follow go to their timelines
+		err = s.pubSaveTimeline(actor, note)
+		if err != nil {
+			log.Warn().Err(err).Str("actor", actor).Str("note", note.Get("id").String()).
+				Msg("error saving note to timelines")
+			http.Error(w, "Failed to accept Create.", 500)
+			return
+		}
+		break
+	case "Accept", "Reject":
+		// responses to our users' Follows
+		if j.Get("object.type").Exists() && j.Get("object.type").String() != "Follow" {
+			break
 		}
+
+		err = s.pubFollowResponse(typ, actor, pubObjectId(j.Get("object")))
+		if err != nil {
+			log.Warn().Err(err).Str("actor", actor).Str("type", typ).
+				Msg("error saving Follow response")
+			http.Error(w, "Failed to accept "+typ+".", 500)
+			return
+		}
+		break
 	case "Delete":
-		actor := j.Get("actor").String()
+		if object := pubObjectId(j.Get("object")); object != actor {
+			// maybe one of the replies or timeline notes we have stored
+			err = s.pubDeleteReply(actor, object)
+			if err == nil {
+				err = s.pubDeleteTimeline(actor, object)
+			}
+			if err != nil {
+				log.Warn().Err(err).Str("actor", actor).Str("object", object).
+					Msg("error deleting reply")
+				http.Error(w, "Failed to accept Delete.", 500)
+				return
+			}
+			break
+		}
 
-		_, err = pg.Exec(`
+		_, err = s.pg.ExecContext(r.Context(), `
                 DELETE FROM pub_user_followers
                 WHERE follower = $1
             `, actor)
@@ -328,53 +561,255 @@ func pubInbox(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
-func pubDispatchNote(id, owner, name, cid string) {
-	create := pub.WrapCreate(makeNote(DBNote{
-		Id:    id,
-		Owner: owner,
-		Name:  name,
-		SetAt: time.Now().Format(time.RFC3339),
-		CID:   cid,
-	}), s.ServiceURL+"/pub/create/"+id)
-	create.Context = litepub.CONTEXT
+// pubDispatchNote tells followers about the latest version of a record.
+// it looks at the ipfs gateway first, so it is run in the background.
+func (s *Server) pubDispatchNote(owner, name string) {
+	if s.pg == nil {
+		return
+	}
 
-	var followers []string
-	err = pg.Select(&followers, `
-SELECT follower FROM pub_user_followers
-WHERE target = $1
-    `, owner)
+	dbnote, err := s.fetchLatestDBNote(owner, name)
 	if err != nil {
 		log.Warn().Err(err).Str("owner", owner).Str("name", name).
-			Msg("failed to fetch followers")
+			Msg("failed to fetch note to dispatch")
 		return
 	}
 
-	for _, target := range followers {
-		log.Print(target)
-		url, err := litepub.FetchInbox(target)
-		log.Print(url, " ", err)
+	// remember what kind of thing this is so it can be shown inline
+	if dbnote.MediaType == "" {
+		_, err = s.pg.Exec(`
+            UPDATE history SET media_type = $2 WHERE id = $1
+        `, dbnote.Id, s.sniffMediaType(dbnote.CID))
 		if err != nil {
-			continue
+			log.Warn().Err(err).Str("id", dbnote.Id).Msg("failed to store media type")
 		}
 
-		resp, err := pub.SendSigned(
-			s.ServiceURL+"/pub/user/"+owner+"#main-key", url, create)
+		// the record may have changed or be gone while we were sniffing
+		dbnote, err = s.fetchLatestDBNote(owner, name)
 		if err != nil {
-			var b []byte
-			if resp != nil && resp.Body != nil {
-				b, _ = ioutil.ReadAll(resp.Body)
-			}
-			log.Warn().Err(err).Str("body", string(b)).
-				Msg("failed to send Accept")
-			continue
+			log.Info().Err(err).Str("owner", owner).Str("name", name).
+				Msg("note gone before dispatch")
+			return
+		}
+	}
+
+	create := s.makeCreate(dbnote)
+	create.Context = litepub.CONTEXT
+
+	err = s.pubEnqueue(owner, create.Id, create)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("failed to queue note for delivery")
+	}
+}
+
+type fetchError struct {
+	url    string
+	status int
+}
+
+func (e fetchError) Error() string {
+	return fmt.Sprintf("fetching %s returned %d", e.url, e.status)
+}
+
+// pubDispatchUpdate tells followers the latest note for a record has
+// changed, after a rename or an edit of its note, body or tags.
+func (s *Server) pubDispatchUpdate(owner, name string) {
+	if s.pg == nil {
+		return
+	}
+
+	dbnote, err := s.fetchLatestDBNote(owner, name)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("failed to fetch note to update")
+		return
+	}
+	if dbnote.author() != owner {
+		// the note is from before a transfer, it isn't theirs to update
+		return
+	}
+
+	update := Activity{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Id: fmt.Sprintf("%s/pub/note/%s#update-%d",
+				s.ServiceURL, dbnote.Id, time.Now().UnixNano()),
+			Type: "Update",
+		},
+		Actor:  s.ServiceURL + "/pub/user/" + owner,
+		To:     pubPublic,
+		Cc:     []string{s.ServiceURL + "/pub/user/" + owner + "/followers"},
+		Object: s.makeNote(dbnote),
+	}
+
+	err = s.pubEnqueue(owner, update.Id, update)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("failed to queue Update for delivery")
+	}
+}
+
+// pubDispatchTransfer shows a record that was just transferred to the
+// followers of its new owner. its note is still the previous owner's, so
+// the new owner Announces it.
+func (s *Server) pubDispatchTransfer(owner, name string) {
+	if s.pg == nil {
+		return
+	}
+
+	dbnote, err := s.fetchLatestDBNote(owner, name)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("failed to fetch note to announce")
+		return
+	}
+	if dbnote.author() == owner {
+		// it was theirs before, their followers have seen it
+		return
+	}
+
+	actor := s.ServiceURL + "/pub/user/" + owner
+	announce := Activity{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Id:      s.ServiceURL + "/pub/note/" + dbnote.Id + "#announce-" + owner,
+			Type:    "Announce",
+		},
+		Actor:     actor,
+		Published: time.Now().UTC().Format(time.RFC3339),
+		To:        pubPublic,
+		Cc:        []string{actor + "/followers", s.ServiceURL + "/pub/user/" + dbnote.author()},
+		Object:    s.ServiceURL + "/pub/note/" + dbnote.Id,
+	}
+
+	err = s.pubEnqueue(owner, announce.Id, announce)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("failed to queue Announce for delivery")
+	}
+}
+
+// pubDispatchActorDelete tells the followers of a deleted user that their
+// actor is gone, so remote servers drop the account.
+func (s *Server) pubDispatchActorDelete(owner string, followers []Follower) {
+	if s.pg == nil || len(followers) == 0 {
+		return
+	}
+
+	actor := s.ServiceURL + "/pub/user/" + owner
+	del := Activity{
+		Base: litepub.Base{
+			Context: litepub.CONTEXT,
+			Id:      actor + "#delete",
+			Type:    "Delete",
+		},
+		Actor:  actor,
+		To:     pubPublic,
+		Object: actor,
+	}
+
+	err := s.pubEnqueueFollowers(owner, del.Id, del, followers)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("failed to queue actor Delete for delivery")
+	}
+}
+
+// pubDispatchDelete tells followers the notes with the given ids are gone.
+func (s *Server) pubDispatchDelete(owner string, ids []string) {
+	if s.pg == nil {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, id := range ids {
+		// notes from before a transfer are deleted by who published them
+		author := owner
+		err := s.pg.Get(&author, `SELECT owner FROM pub_tombstones WHERE id = $1`, id)
+		if err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("failed to fetch tombstone")
+		}
+
+		del := Activity{
+			Base: litepub.Base{
+				Context: litepub.CONTEXT,
+				Id:      s.ServiceURL + "/pub/note/" + id + "#delete",
+				Type:    "Delete",
+			},
+			Actor: s.ServiceURL + "/pub/user/" + author,
+			To:    pubPublic,
+			Object: Tombstone{
+				Base: litepub.Base{
+					Id:   s.ServiceURL + "/pub/note/" + id,
+					Type: "Tombstone",
+				},
+				FormerType: "Note",
+				Deleted:    now,
+			},
 		}
 
-		log.Print(resp.Request.Header)
-		log.Print(resp.StatusCode)
-		var b []byte
-		if resp != nil && resp.Body != nil {
-			b, _ = ioutil.ReadAll(resp.Body)
-			log.Print(string(b))
+		err = s.pubEnqueue(author, del.Id, del)
+		if err != nil {
+			log.Warn().Err(err).Str("owner", author).Str("id", id).
+				Msg("failed to queue Delete for delivery")
 		}
 	}
 }
+
+func fetchActor(actor string) (j gjson.Result, err error) {
+	req, err := http.NewRequest("GET", actor, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/activity+json")
+
+	resp, err := pubClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		err = fetchError{url: actor, status: resp.StatusCode}
+		return
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	j = gjson.ParseBytes(b)
+	return
+}
+
+func fetchActorInboxes(actor string) (inbox, sharedInbox string, err error) {
+	j, err := fetchActor(actor)
+	if err != nil {
+		return
+	}
+
+	inbox = j.Get("inbox").String()
+	sharedInbox = j.Get("endpoints.sharedInbox").String()
+	if inbox == "" {
+		err = fmt.Errorf("%s has no inbox", actor)
+	}
+	return
+}
+
+func actorIsGone(actor string) bool {
+	_, err := fetchActor(actor)
+	if ferr, ok := err.(fetchError); ok {
+		return ferr.status == 404 || ferr.status == 410
+	}
+	return false
+}
+
+// pubObjectId returns the id of an object that may be given inline or
+// just as its id.
+func pubObjectId(object gjson.Result) string {
+	if object.IsObject() {
+		return object.Get("id").String()
+	}
+	return object.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+)
+
+// pubUserKey returns the key used to sign activities from owner's actor,
+// generating and storing it the first time it's needed. deleted users still
+// have theirs, to sign the Delete of their actor.
+func (s *Server) pubUserKey(owner string) (*rsa.PrivateKey, error) {
+	var skpem string
+	err := s.pg.Get(&skpem, `SELECT actor_sk FROM users WHERE name = $1`, owner)
+	if err == sql.ErrNoRows {
+		err = s.pg.Get(&skpem, `SELECT actor_sk FROM pub_deleted_actors WHERE name = $1`, owner)
+		if err != nil {
+			return nil, err
+		}
+		return parseActorKey(owner, skpem)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if skpem == "" {
+		sk, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+
+		// if someone else generated a key in the meantime we use theirs
+		err = s.pg.Get(&skpem, `
+            UPDATE users SET actor_sk = CASE WHEN actor_sk = '' THEN $2 ELSE actor_sk END
+            WHERE name = $1
+            RETURNING actor_sk
+        `, owner, string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(sk),
+		})))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return parseActorKey(owner, skpem)
+}
+
+func parseActorKey(owner, skpem string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(skpem))
+	if block == nil {
+		return nil, errors.New("invalid actor key pem for " + owner)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func (s *Server) pubUserPublicKeyPEM(owner string) (string, error) {
+	sk, err := s.pubUserKey(owner)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: key,
+	})), nil
+}
+
+func (s *Server) pubUserKeyId(owner string) string {
+	return s.ServiceURL + "/pub/user/" + owner + "#main-key"
+}
+
+// pubSendAs signs data with owner's key and posts it to inbox, giving up
+// when ctx is done.
+func (s *Server) pubSendAs(ctx context.Context, owner, inbox string, data interface{}) (*http.Response, error) {
+	sk, err := s.pubUserKey(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := pubSignedRequest(inbox, data, s.pubUserKeyId(owner), sk)
+	if err != nil {
+		return nil, err
+	}
+	return pubClient.Do(req.WithContext(ctx))
+}
+
+// pubSignedRequest is the POST of data to inbox, signed with sk.
+func pubSignedRequest(inbox string, data interface{}, keyId string, sk *rsa.PrivateKey) (*http.Request, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+	if err := signRequest(req, body, keyId, sk); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter keeps one token bucket per key (an ip or a user name). buckets
+// that weren't used for a while are forgotten.
+type Limiter struct {
+	name   string
+	limit  rate.Limit
+	burst  int
+	period time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newLimiter allows n requests per period for each key, all of them at
+// once if needed. a nil Limiter, from n <= 0, allows everything.
+func newLimiter(name string, n int, period time.Duration) *Limiter {
+	if n <= 0 {
+		return nil
+	}
+	return &Limiter{
+		name:      name,
+		limit:     rate.Limit(float64(n) / period.Seconds()),
+		burst:     n,
+		period:    period,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token for key, or says how long until there is one.
+func (l *Limiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > l.period {
+		// a bucket unused for a whole period is full again anyway
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > l.period {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+type Limits struct {
+	registrations *Limiter
+	writes        *Limiter
+	userWrites    *Limiter
+	inbox         *Limiter
+}
+
+func newLimits(s Settings) Limits {
+	return Limits{
+		registrations: newLimiter("registrations", s.RegistrationsPerHour, time.Hour),
+		writes:        newLimiter("writes", s.WritesPerMinute, time.Minute),
+		userWrites:    newLimiter("user_writes", s.WritesPerMinute, time.Minute),
+		inbox:         newLimiter("inbox", s.InboxPerMinute, time.Minute),
+	}
+}
+
+// rateLimited answers with 429 and returns true if key is over the limit.
+func (s *Server) rateLimited(w http.ResponseWriter, l *Limiter, key string) bool {
+	ok, retryAfter := l.Allow(key)
+	if ok {
+		return false
+	}
+
+	s.metrics.rateLimited.WithLabelValues(l.name).Inc()
+	w.Header().Set("Retry-After",
+		strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many requests.", 429)
+	return true
+}
+
+// limitIP wraps a handler with a limit on requests per client ip.
+func (s *Server) limitIP(l *Limiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimited(w, l, s.clientIP(r)) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP is the address of whoever made the request. behind a proxy,
+// like on heroku, that is the last address it added to X-Forwarded-For.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.TrustProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	gocid "github.com/ipfs/go-cid"
+)
+
+const maxReportDescription = 5000
+
+// reportName lets anyone, logged in or not, tell the admins about a record.
+func (s *Server) reportName(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+	name := mux.Vars(r)["name"]
+
+	var report Report
+	err := json.NewDecoder(r.Body).Decode(&report)
+	if err != nil {
+		http.Error(w, "Invalid JSON body.", 400)
+		return
+	}
+
+	if !contains(ReportCategories, report.Category) {
+		http.Error(w, "Category must be one of "+strings.Join(ReportCategories, ", ")+".", 400)
+		return
+	}
+	if len(report.Description) > maxReportDescription {
+		http.Error(w, "Description too long.", 413)
+		return
+	}
+
+	cid, err := s.store.RecordCID(r.Context(), owner, name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Record not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	report.Owner = owner
+	report.Name = name
+	report.CID = cid
+	id, err := s.store.AddReport(r.Context(), report)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("error saving report")
+		http.Error(w, "Error saving report.", 500)
+		return
+	}
+
+	log.Info().Int("id", id).Str("owner", owner).Str("name", name).
+		Str("category", report.Category).Msg("record reported")
+	w.WriteHeader(200)
+}
+
+// adminListReports is the moderation queue, only unresolved reports unless
+// ?all=1 is given.
+func (s *Server) adminListReports(w http.ResponseWriter, r *http.Request, admin string) {
+	reports, err := s.store.ListReports(r.Context(), r.URL.Query().Get("all") == "1")
+	if err != nil {
+		log.Warn().Err(err).Msg("error fetching reports")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// adminResolveReport dismisses a report or acts on the record it is about.
+// acting on the record resolves all the other open reports about it too.
+func (s *Server) adminResolveReport(w http.ResponseWriter, r *http.Request, admin string) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var body struct {
+		Action string `json:"action"`
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	report, err := s.store.GetReport(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Report not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Int("id", id).Msg("error fetching report")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+	if report.ResolvedAt != nil {
+		http.Error(w, "Report already resolved.", 409)
+		return
+	}
+
+	switch body.Action {
+	case "dismiss":
+		err = s.store.ResolveReport(r.Context(), id, admin, "dismissed")
+		if err == nil {
+			s.audit(r.Context(), admin, "dismiss_report", strconv.Itoa(id), body.Reason)
+		}
+	case "hide", "takedown":
+		state := RecordHidden
+		if body.Action == "takedown" {
+			state = RecordTakenDown
+		}
+		err = s.changeRecordState(r.Context(), admin, report.Owner, report.Name, state, body.Reason)
+		if err == nil {
+			err = s.store.ResolveRecordReports(r.Context(),
+				report.Owner, report.Name, admin, state)
+		}
+	default:
+		http.Error(w, "Action must be dismiss, hide or takedown.", 400)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Record not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Int("id", id).Msg("error resolving report")
+		http.Error(w, "Error resolving report: "+err.Error(), 500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func (s *Server) adminListDeniedCIDs(w http.ResponseWriter, r *http.Request, admin string) {
+	cids, err := s.store.ListDeniedCIDs(r.Context())
+	if err != nil {
+		log.Warn().Err(err).Msg("error fetching denied cids")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cids)
+}
+
+func (s *Server) adminDenyCID(w http.ResponseWriter, r *http.Request, admin string) {
+	pcid, err := gocid.Parse(mux.Vars(r)["cid"])
+	if err != nil {
+		http.Error(w, "Invalid CID.", 400)
+		return
+	}
+	cid := pcid.String()
+	reason := adminReason(r)
+
+	err = s.store.DenyCID(r.Context(), cid, reason)
+	if err != nil {
+		log.Warn().Err(err).Str("cid", cid).Msg("error denying cid")
+		http.Error(w, "Error denying CID: "+err.Error(), 500)
+		return
+	}
+
+	s.audit(r.Context(), admin, "deny_cid", cid, reason)
+	w.WriteHeader(200)
+}
+
+// adminAllowCID lifts a denial added by hand, the ones from records taken
+// down stay until those records are restored.
+func (s *Server) adminAllowCID(w http.ResponseWriter, r *http.Request, admin string) {
+	cid := mux.Vars(r)["cid"]
+	if pcid, err := gocid.Parse(cid); err == nil {
+		cid = pcid.String()
+	}
+
+	err := s.store.AllowCID(r.Context(), cid)
+	if err != nil {
+		log.Warn().Err(err).Str("cid", cid).Msg("error allowing cid")
+		http.Error(w, "Error allowing CID: "+err.Error(), 500)
+		return
+	}
+
+	s.audit(r.Context(), admin, "allow_cid", cid, "")
+	w.WriteHeader(200)
+}
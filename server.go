@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/litepub"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// Server owns everything a running gravity needs. handlers are methods on
+// it so nothing is shared between requests except what is in here.
+type Server struct {
+	Settings
+
+	store   Storage
+	pg      *sqlx.DB // only set with the postgres storage
+	pub     litepub.LitePub
+	router  *mux.Router
+	http    *http.Server
+	metrics *Metrics
+	limits  Limits
+	mailer  Mailer
+
+	// denylist is nil when there's no DENYLIST_FILE
+	denylist *Denylist
+
+	// deliveryWake is used to tell the worker there's new stuff in the
+	// queue so it doesn't have to wait for the next tick.
+	deliveryWake chan struct{}
+
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+
+	// abortDeliveries interrupts the requests the delivery worker is
+	// still making when Shutdown runs out of time.
+	abortDeliveries context.CancelFunc
+}
+
+func NewServer(settings Settings, db Storage, mailer Mailer) *Server {
+	s := &Server{
+		Settings:     settings,
+		store:        db,
+		mailer:       mailer,
+		pub:          litepub.LitePub{},
+		deliveryWake: make(chan struct{}, 1),
+	}
+	if p, ok := db.(PostgresStorage); ok {
+		s.pg = p.db
+	}
+
+	if settings.DenylistFile != "" {
+		s.denylist = &Denylist{Path: settings.DenylistFile}
+		if _, err := s.denylist.Reload(); err != nil {
+			log.Warn().Err(err).Str("path", settings.DenylistFile).Msg("failed to load denylist")
+		} else {
+			log.Info().Int("entries", s.denylist.Len()).Msg("denylist loaded")
+		}
+	}
+
+	s.limits = newLimits(settings)
+	s.metrics = newMetrics(s)
+	s.store = measuredStorage{db, s.metrics}
+
+	s.router = s.newRouter()
+	s.http = &http.Server{
+		Handler:      s.router,
+		Addr:         "0.0.0.0:" + s.Port,
+		WriteTimeout: 25 * time.Second,
+		ReadTimeout:  25 * time.Second,
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// ListenAndServe starts the background workers and serves until Shutdown.
+func (s *Server) ListenAndServe() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWorkers = cancel
+	sendCtx, abort := context.WithCancel(context.Background())
+	s.abortDeliveries = abort
+
+	if s.pg != nil {
+		// activitypub deliveries are sent in the background
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.pubDeliveryWorker(ctx, sendCtx)
+		}()
+
+		// records from other gravity servers are synced periodically
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.mirrorWorker(ctx)
+		}()
+	}
+
+	if s.denylist != nil {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.denylistWorker(ctx)
+		}()
+	}
+
+	log.Info().Str("port", s.Port).Msg("listening.")
+	err := s.http.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests, waits for the ones in flight and then
+// for the delivery worker to send what is still pending, until ctx is done.
+// deliveries that couldn't be sent stay queued for the next start.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.http.Shutdown(ctx)
+
+	if s.stopWorkers != nil {
+		s.stopWorkers()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if s.abortDeliveries != nil {
+			s.abortDeliveries()
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// inBackground runs f after the request is done, Shutdown waits for it.
+func (s *Server) inBackground(f func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f()
+	}()
+}
+
+// newRouter defines all routes. federation routes are only added when the
+// storage is postgres.
+func (s *Server) newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(s.logRequests)
+
+	r.Path("/metrics").Methods("GET").Handler(s.metrics.Handler())
+	r.Path("/icon.svg").Methods("GET").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			fmt.Fprint(w, s.IconSVG)
+			return
+		})
+
+	// federation needs the postgres storage
+	if s.pg != nil {
+		r.Path("/pub").HandlerFunc(s.limitIP(s.limits.inbox, s.pubInbox))
+		r.Path("/pub/user/{owner:[\\d\\w-]+}").Methods("GET").HandlerFunc(s.pubUserActor)
+		r.Path("/pub/user/{owner:[\\d\\w-]+}/followers").Methods("GET").HandlerFunc(s.pubUserFollowers)
+		r.Path("/pub/user/{owner:[\\d\\w-]+}/following").Methods("GET").HandlerFunc(s.pubUserFollowing)
+		r.Path("/pub/user/{owner:[\\d\\w-]+}/featured").Methods("GET").HandlerFunc(s.pubUserFeatured)
+		r.Path("/pub/user/{owner:[\\d\\w-]+}/liked").Methods("GET").HandlerFunc(s.pubUserLiked)
+		r.Path("/pub/user/{owner:[\\d\\w-]+}/outbox").Methods("GET").HandlerFunc(s.pubOutbox)
+		r.Path("/pub/user/{owner:[\\d\\w-]+}/relationships").Methods("GET").
+			HandlerFunc(s.pubUserRelationships)
+		r.Path("/pub/user/{owner:[\\d\\w-]+}/records").Methods("GET").HandlerFunc(s.pubUserRecords)
+		r.Path("/pub/create/{id}").Methods("GET").HandlerFunc(s.pubCreate)
+		r.Path("/pub/note/{id}").Methods("GET").HandlerFunc(s.pubNote)
+		r.Path("/pub/mirrors").Methods("GET").HandlerFunc(s.listMirrors)
+		r.Path("/pub/mirrors").Methods("POST").HandlerFunc(s.addMirror)
+		r.Path("/pub/mirrors/{id}").Methods("DELETE").HandlerFunc(s.delMirror)
+		r.Path("/.well-known/webfinger").HandlerFunc(s.webfinger)
+		r.Path("/.well-known/host-meta").Methods("GET").HandlerFunc(s.hostMeta)
+		r.Path("/.well-known/host-meta.json").Methods("GET").HandlerFunc(s.hostMeta)
+		r.Path("/authorize_interaction").Methods("GET").HandlerFunc(s.authorizeInteraction)
+		r.Path("/.well-known/nodeinfo").Methods("GET").HandlerFunc(s.nodeinfoLinks)
+		r.Path("/nodeinfo/2.0").Methods("GET").HandlerFunc(s.nodeinfo)
+	}
+
+	r.Path("/instance").Methods("GET").HandlerFunc(s.instance)
+
+	if s.pg != nil {
+		r.Path("/feed.{format:atom|rss}").Methods("GET").HandlerFunc(s.feed)
+		r.Path("/{owner:[\\d\\w-]+}.{format:atom|rss}").Methods("GET").HandlerFunc(s.feed)
+		r.Path("/{owner:[\\d\\w-]+}/{name:[\\d\\w-.]+}.{format:atom|rss}").Methods("GET").
+			HandlerFunc(s.feed)
+		r.Path("/{owner:[\\d\\w-]+}/timeline").Methods("GET").HandlerFunc(s.getTimeline)
+	}
+
+	r.Path("/admin/users").Methods("GET").HandlerFunc(s.requireAdmin(s.adminListUsers))
+	r.Path("/admin/users/{owner}/{action:suspend|unsuspend}").Methods("POST").
+		HandlerFunc(s.requireAdmin(s.adminSuspendUser))
+	r.Path("/admin/users/{owner}").Methods("DELETE").HandlerFunc(s.requireAdmin(s.adminDeleteUser))
+	r.Path("/admin/records/{owner}/{name}/state").Methods("POST").
+		HandlerFunc(s.requireAdmin(s.adminSetRecordState))
+	r.Path("/admin/log").Methods("GET").HandlerFunc(s.requireAdmin(s.adminAuditLog))
+	r.Path("/admin/reports").Methods("GET").HandlerFunc(s.requireAdmin(s.adminListReports))
+	r.Path("/admin/reports/{id:[0-9]+}").Methods("POST").
+		HandlerFunc(s.requireAdmin(s.adminResolveReport))
+	r.Path("/admin/denylist").Methods("GET").HandlerFunc(s.requireAdmin(s.adminListDeniedCIDs))
+	r.Path("/admin/denylist/{cid}").Methods("PUT").HandlerFunc(s.requireAdmin(s.adminDenyCID))
+	r.Path("/admin/denylist/{cid}").Methods("DELETE").HandlerFunc(s.requireAdmin(s.adminAllowCID))
+	if s.pg != nil {
+		r.Path("/admin/blocks").Methods("GET").HandlerFunc(s.requireAdmin(s.adminListBlocks))
+		r.Path("/admin/blocks/{domain}").Methods("PUT").
+			HandlerFunc(s.requireAdmin(s.adminBlockDomain))
+		r.Path("/admin/blocks/{domain}").Methods("DELETE").
+			HandlerFunc(s.requireAdmin(s.adminUnblockDomain))
+		r.Path("/admin/deliveries").Methods("GET").HandlerFunc(s.requireAdmin(s.pubDeliveriesStatus))
+		r.Path("/admin/deliveries/{id:[0-9]+}/retry").Methods("POST").
+			HandlerFunc(s.requireAdmin(s.pubDeliveryRetry))
+	}
+
+	r.Path("/verify/{owner}/{token}").Methods("GET").HandlerFunc(s.verifyEmail)
+
+	r.Path("/{owner}").Methods("POST").HandlerFunc(s.limitIP(s.limits.registrations, s.registerUser))
+	r.Path("/{owner}/").Methods("POST").HandlerFunc(s.limitIP(s.limits.registrations, s.registerUser))
+
+	r.Path("/{owner}").Methods("PATCH").HandlerFunc(s.limitIP(s.limits.writes, s.updateUser))
+	r.Path("/{owner}/").Methods("PATCH").HandlerFunc(s.limitIP(s.limits.writes, s.updateUser))
+
+	r.Path("/{owner}/{name}").Methods("PUT").HandlerFunc(s.limitIP(s.limits.writes, s.setName))
+	r.Path("/{owner}/{name}/").Methods("PUT").HandlerFunc(s.limitIP(s.limits.writes, s.setName))
+
+	r.Path("/{owner}/{name}").Methods("PATCH").HandlerFunc(s.limitIP(s.limits.writes, s.updateName))
+	r.Path("/{owner}/{name}/").Methods("PATCH").HandlerFunc(s.limitIP(s.limits.writes, s.updateName))
+
+	r.Path("/{owner}/{name}/aliases/{alias:[\\d\\w-.]+}").Methods("PUT", "DELETE").
+		HandlerFunc(s.limitIP(s.limits.writes, s.setAlias))
+
+	r.Path("/{owner}/{name}/transfer").Methods("POST", "DELETE").
+		HandlerFunc(s.limitIP(s.limits.writes, s.offerTransfer))
+	r.Path("/{owner}/{name}/transfer/accept").Methods("POST").
+		HandlerFunc(s.limitIP(s.limits.writes, s.acceptTransfer))
+
+	r.Path("/{owner}/{name}/report").Methods("POST").
+		HandlerFunc(s.limitIP(s.limits.writes, s.reportName))
+
+	r.Path("/{owner}/{name}").Methods("DELETE").HandlerFunc(s.limitIP(s.limits.writes, s.delName))
+	r.Path("/{owner}/{name}/").Methods("DELETE").HandlerFunc(s.limitIP(s.limits.writes, s.delName))
+
+	r.Path("/").Methods("GET").Queries("cid", "").
+		HandlerFunc(switchHTMLJSON(s.queryCIDs))
+	r.Path("/{owner:[\\d\\w-]+}").Methods("GET").Queries("cid", "").
+		HandlerFunc(switchHTMLJSON(s.queryCIDs))
+	r.Path("/{owner:[\\d\\w-]+}/").Methods("GET").Queries("cid", "").
+		HandlerFunc(switchHTMLJSON(s.queryCIDs))
+
+	r.Path("/{owner:[\\d\\w-]+}").Methods("GET").
+		HandlerFunc(switchHTMLJSON(s.getUser))
+
+	r.Path("/").Methods("GET").
+		HandlerFunc(switchHTMLJSON(s.listNames))
+	r.Path("/{owner:[\\d\\w-]+}/").Methods("GET").
+		HandlerFunc(switchHTMLJSON(s.listNames))
+
+	r.Path("/{owner:[\\d\\w-]+}/{name:[\\d\\w-.]+}").Methods("GET").
+		HandlerFunc(switchHTMLJSON(s.getName))
+	r.Path("/{owner:[\\d\\w-]+}/{name:[\\d\\w-.]+}/").Methods("GET").
+		HandlerFunc(switchHTMLJSON(s.getName))
+
+	if s.pg != nil {
+		// read-only copies of records from other servers, as host/owner/name
+		r.Path("/{host:[\\w-]+(?:\\.[\\w-]+)+(?::\\d+)?}/{owner:[\\d\\w-]+}/{name:[\\d\\w-.]+}").
+			Methods("GET").HandlerFunc(switchHTMLJSON(s.getName))
+	}
+
+	r.Path("/r/{owner}/{name}").Methods("GET").HandlerFunc(s.redirectName)
+	r.Path("/r/{owner}/{name}/").Methods("GET").HandlerFunc(s.redirectName)
+
+	r.PathPrefix("/").Methods("GET").Handler(http.FileServer(http.Dir("./static")))
+
+	return r
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("GRAVITY_TEST_LOG") == "" {
+		log = zerolog.Nop()
+	}
+	os.Exit(m.Run())
+}
+
+const testAdminToken = "admin-token"
+
+// testServer is a gravity with an ephemeral storage: sqlite in a temporary
+// directory, or a fresh postgres schema when GRAVITY_TEST_DATABASE_URL is
+// set. requests go straight to the router, nothing listens on a port.
+type testServer struct {
+	*Server
+	t    *testing.T
+	mail *testMailer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	settings := Settings{
+		ServiceName:             "gravity",
+		ServiceURL:              "https://gravity.test",
+		Port:                    "0",
+		Storage:                 "sqlite",
+		SQLitePath:              filepath.Join(t.TempDir(), "gravity.db"),
+		IPFSGateway:             "http://127.0.0.1:1",
+		OpenRegistrations:       true,
+		PubDeliveryConcurrency:  1,
+		PubDeliveryMaxAttempts:  1,
+		MaxRecordsPerUser:       1000,
+		MaxBodySize:             65536,
+		VerificationGracePeriod: 24 * time.Hour,
+		AdminToken:              testAdminToken,
+	}
+	if dburl := os.Getenv("GRAVITY_TEST_DATABASE_URL"); dburl != "" {
+		settings.Storage = "postgres"
+		settings.PostgresURL = testSchema(t, dburl)
+	}
+
+	store, err := openStorage(settings)
+	if err != nil {
+		t.Fatalf("couldn't open %s storage: %s", settings.Storage, err)
+	}
+
+	mail := &testMailer{}
+	return &testServer{Server: NewServer(settings, store, mail), t: t, mail: mail}
+}
+
+// testSchema creates a schema that only lives during the test and returns
+// a database url that uses it.
+func testSchema(t *testing.T, dburl string) string {
+	db, err := sqlx.Connect("postgres", dburl)
+	if err != nil {
+		t.Fatalf("couldn't connect to postgres: %s", err)
+	}
+	schema := fmt.Sprintf("gravity_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("couldn't create schema: %s", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+
+	if u, err := url.Parse(dburl); err == nil && u.Scheme != "" {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dburl + " search_path=" + schema
+}
+
+// do sends a request to the server as a client would.
+func (ts *testServer) do(method, path, token, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Accept", "application/json")
+	if token != "" {
+		r.Header.Set("Token", token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, r)
+	return w
+}
+
+// testUser signs its requests like the cli does.
+type testUser struct {
+	name string
+	sk   *rsa.PrivateKey
+}
+
+// register creates a user with a new key, its email is confirmed.
+func (ts *testServer) register(name string) *testUser {
+	ts.t.Helper()
+
+	u := &testUser{name: name, sk: newKey(ts.t)}
+	pk := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&u.sk.PublicKey),
+	})
+	w := ts.do("POST", "/"+name, "", string(pk), "Email", name+"@example.com")
+	if w.Code != 200 {
+		ts.t.Fatalf("couldn't register %s: %d %s", name, w.Code, w.Body.String())
+	}
+
+	// follow the link in the email
+	mail := ts.mail.last()
+	i := strings.Index(mail.Body, ts.ServiceURL+"/verify/")
+	if mail.To != name+"@example.com" || i == -1 {
+		ts.t.Fatalf("no verification email for %s", name)
+	}
+	link := strings.Fields(mail.Body[i:])[0]
+	if w := ts.do("GET", strings.TrimPrefix(link, ts.ServiceURL), "", ""); w.Code != 200 {
+		ts.t.Fatalf("couldn't verify %s: %d %s", name, w.Code, w.Body.String())
+	}
+	return u
+}
+
+func (u *testUser) token(t *testing.T, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(u.sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testMailer keeps emails so tests can look at them.
+type testMailer struct {
+	mu   sync.Mutex
+	sent []testMail
+}
+
+type testMail struct {
+	To, Subject, Body string
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, testMail{to, subject, body})
+	return nil
+}
+
+func (m *testMailer) last() testMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		return testMail{}
+	}
+	return m.sent[len(m.sent)-1]
+}
+
+// apiTest is one request in a sequence, later ones see what earlier ones did.
+type apiTest struct {
+	name   string
+	method string
+	path   string
+	user   *testUser     // who signs the token
+	claims jwt.MapClaims // what goes in the token
+	token  string        // used as is when there is no user
+	body   string
+	status int
+	check  func(t *testing.T, body string)
+}
+
+func (ts *testServer) run(tests []apiTest) {
+	for _, test := range tests {
+		ts.t.Run(test.name, func(t *testing.T) {
+			token := test.token
+			if test.user != nil {
+				token = test.user.token(t, test.claims)
+			}
+
+			w := ts.do(test.method, test.path, token, test.body)
+			if w.Code != test.status {
+				t.Fatalf("%s %s: status %d, expected %d: %s",
+					test.method, test.path, w.Code, test.status, w.Body.String())
+			}
+			if test.check != nil {
+				test.check(t, w.Body.String())
+			}
+		})
+	}
+}
+
+// expect fails the test when the gjson path in body isn't value.
+func expect(path string, value interface{}) func(t *testing.T, body string) {
+	return func(t *testing.T, body string) {
+		t.Helper()
+		if got := gjson.Get(body, path).String(); got != fmt.Sprint(value) {
+			t.Errorf("%s is %q, expected %q in %s", path, got, fmt.Sprint(value), body)
+		}
+	}
+}
+
+// requireFederation skips tests that need the postgres storage.
+func (ts *testServer) requireFederation() {
+	ts.t.Helper()
+	if ts.pg == nil {
+		ts.t.Skip("federation needs GRAVITY_TEST_DATABASE_URL")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Storage is where users, their records and everything around them live.
+// ActivityPub deliveries, mirrors and the other federation stuff still talk
+// to postgres directly and are only available with the postgres backend.
+type Storage interface {
+	CreateUser(ctx context.Context, name, email, pk, verificationToken string) error
+	GetAccount(ctx context.Context, name string) (Account, error)
+	VerifyEmail(ctx context.Context, name, token string) (ok bool, err error)
+	GetUser(ctx context.Context, name string) (UserInfo, error)
+	UserPublicKey(ctx context.Context, name string) (string, error)
+	UpdateUser(ctx context.Context, name string, fields map[string]interface{}) error
+
+	ListRecords(ctx context.Context, owner, tag string) ([]Entry, error)
+	GetRecord(ctx context.Context, owner, name string, full bool) (Entry, error)
+	RecordCID(ctx context.Context, owner, name string) (string, error)
+	CountRecords(ctx context.Context, owner string) (int, error)
+	SetRecord(ctx context.Context, owner, name, cid, note string) error
+	UpdateRecord(ctx context.Context, owner, name string, fields map[string]interface{}) error
+	DeleteRecord(ctx context.Context, owner, name string) (noteIds []string, err error)
+	QueryCID(ctx context.Context, cid, owner string) ([]HistoryEntry, error)
+	RenameRecord(ctx context.Context, owner, name, newName string) error
+
+	AddAlias(ctx context.Context, owner, name, alias string) error
+	RemoveAlias(ctx context.Context, owner, name, alias string) error
+	ResolveAlias(ctx context.Context, owner, alias string) (newOwner, name string, err error)
+
+	OfferTransfer(ctx context.Context, owner, name, recipient string) error
+	CancelTransfer(ctx context.Context, owner, name string) error
+	GetTransfer(ctx context.Context, owner, name string) (recipient string, err error)
+	TransferRecord(ctx context.Context, owner, name, newOwner string) error
+
+	Star(ctx context.Context, source, owner, name string) error
+	Unstar(ctx context.Context, source, owner, name string) error
+
+	AddFollower(ctx context.Context, owner string, follower Follower) (pending bool, err error)
+	RemoveFollower(ctx context.Context, owner, actor string) error
+	ListFollowers(ctx context.Context, owner string) ([]FollowerInfo, error)
+
+	Stats(ctx context.Context) (Stats, error)
+
+	ListAccounts(ctx context.Context) ([]Account, error)
+	SuspendUser(ctx context.Context, name string, suspended bool, reason string) error
+	DeleteUser(ctx context.Context, name string) (followers []Follower, err error)
+	SetRecordState(ctx context.Context, owner, name, state, reason string) error
+	AddAuditEntry(ctx context.Context, entry AuditEntry) error
+	ListAuditLog(ctx context.Context, limit int) ([]AuditEntry, error)
+
+	AddReport(ctx context.Context, report Report) (id int, err error)
+	GetReport(ctx context.Context, id int) (Report, error)
+	ListReports(ctx context.Context, all bool) ([]Report, error)
+	ResolveReport(ctx context.Context, id int, admin, resolution string) error
+	ResolveRecordReports(ctx context.Context, owner, name, admin, resolution string) error
+	DenyCID(ctx context.Context, cid, reason string) error
+	AllowCID(ctx context.Context, cid string) error
+	IsCIDDenied(ctx context.Context, cid string) (bool, error)
+	ListDeniedCIDs(ctx context.Context) ([]DeniedCID, error)
+}
+
+// Account is what we know about a user that isn't public.
+type Account struct {
+	Name             string     `json:"name" db:"name"`
+	Email            string     `json:"email" db:"email"`
+	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+	VerifiedAt       *time.Time `json:"verified_at" db:"verified_at"`
+	SuspendedAt      *time.Time `json:"suspended_at" db:"suspended_at"`
+	SuspensionReason string     `json:"suspension_reason,omitempty" db:"suspension_reason"`
+	NRecords         int        `json:"nrecords" db:"nrecords"`
+}
+
+// records are always in one of these states, only visible ones are shown.
+const (
+	RecordVisible   = "visible"
+	RecordHidden    = "hidden"
+	RecordTakenDown = "taken_down"
+)
+
+// AuditEntry is something an admin did.
+type AuditEntry struct {
+	Id        int       `json:"id" db:"id"`
+	Admin     string    `json:"admin" db:"admin"`
+	Action    string    `json:"action" db:"action"`
+	Target    string    `json:"target" db:"target"`
+	Reason    string    `json:"reason,omitempty" db:"reason"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// reports can be about one of these things.
+var ReportCategories = []string{"illegal", "copyright", "abuse", "spam", "other"}
+
+// Report is a complaint about a record, sent by anyone. it stays in the
+// moderation queue until an admin resolves it.
+type Report struct {
+	Id          int        `json:"id" db:"id"`
+	Owner       string     `json:"owner" db:"owner"`
+	Name        string     `json:"name" db:"name"`
+	CID         string     `json:"cid" db:"cid"`
+	Category    string     `json:"category" db:"category"`
+	Description string     `json:"description" db:"description"`
+	Contact     string     `json:"contact,omitempty" db:"contact"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+	ResolvedBy  string     `json:"resolved_by,omitempty" db:"resolved_by"`
+	Resolution  string     `json:"resolution,omitempty" db:"resolution"`
+}
+
+// DeniedCID can't be published by anyone, usually because a record
+// pointing to it was taken down.
+type DeniedCID struct {
+	CID       string    `json:"cid" db:"cid"`
+	Reason    string    `json:"reason,omitempty" db:"reason"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type Stats struct {
+	Users   int `db:"users"`
+	Records int `db:"records"`
+}
+
+type Follower struct {
+	Actor       string `db:"follower"`
+	Inbox       string `db:"inbox"`
+	SharedInbox string `db:"shared_inbox"`
+	FollowId    string `db:"follow_id"`
+}
+
+var errNoFederation = errors.New("this needs the postgres storage backend")
+
+// UserFields are the only columns UpdateUser touches, everything else about
+// a user has its own method.
+var UserFields = []string{"manually_approves_followers"}
+
+// RecordFields are the only columns UpdateRecord touches. the cid only
+// changes through SetRecord, the owner through transfers and the state
+// through admins.
+var RecordFields = []string{"note", "body", "pinned", "tags"}
+
+// setClause is "a = ?, b = ?" for the fields that are in allowed. column
+// names are always taken from allowed, never from the caller.
+func setClause(fields map[string]interface{}, allowed []string) (string, []interface{}, error) {
+	for k := range fields {
+		if !contains(allowed, k) {
+			return "", nil, fmt.Errorf("%s can't be changed", k)
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	values := make([]interface{}, 0, len(fields))
+	for _, k := range allowed {
+		if v, ok := fields[k]; ok {
+			keys = append(keys, k+" = ?")
+			values = append(values, v)
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil, errors.New("nothing to change")
+	}
+	return strings.Join(keys, ", "), values, nil
+}
+
+func openStorage(s Settings) (Storage, error) {
+	switch s.Storage {
+	case "postgres":
+		if s.PostgresURL == "" {
+			return nil, errors.New("DATABASE_URL is required for the postgres storage")
+		}
+
+		db, err := sqlx.Connect("postgres", s.PostgresURL)
+		if err != nil {
+			return nil, err
+		}
+		// bring the schema up to date
+		if err := migrateUp(db); err != nil {
+			return nil, err
+		}
+		return PostgresStorage{db}, nil
+	case "sqlite":
+		db, err := sqlx.Connect("sqlite3", s.SQLitePath+"?_foreign_keys=1")
+		if err != nil {
+			return nil, err
+		}
+
+		// sqlite can't write from many connections at the same time
+		db.SetMaxOpenConns(1)
+
+		if err := sqliteMigrate(db); err != nil {
+			return nil, err
+		}
+		return SQLiteStorage{db}, nil
+	default:
+		return nil, errors.New("unknown storage '" + s.Storage + "'")
+	}
+}
+
+// setRecord does what the update_history trigger used to do: whenever the
+// cid of a record changes a new history entry is added pointing to the
+// previous one. queries are written with ? so they work on every backend.
+func setRecord(ctx context.Context, txn *sqlx.Tx, owner, name, cid, note string) error {
+	res, err := txn.ExecContext(ctx, txn.Rebind(`
+        INSERT INTO head (owner, name, cid, note) VALUES (?, ?, ?, ?)
+        ON CONFLICT (owner, name) DO NOTHING
+    `), owner, name, cid, note)
+	if err != nil {
+		return err
+	}
+	created, _ := res.RowsAffected()
+
+	if created > 0 {
+		// a new record takes its name back from an alias
+		_, err = txn.ExecContext(ctx, txn.Rebind(`
+            DELETE FROM aliases WHERE owner = ? AND name = ?
+        `), owner, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	var current struct {
+		Id  int64  `db:"id"`
+		CID string `db:"cid"`
+	}
+	err = txn.GetContext(ctx, &current, txn.Rebind(`
+        SELECT id, cid FROM head WHERE owner = ? AND name = ?
+    `), owner, name)
+	if err != nil {
+		return err
+	}
+
+	if created == 0 {
+		if note == "" {
+			_, err = txn.ExecContext(ctx, txn.Rebind(`
+                UPDATE head SET cid = ?, updated_at = CURRENT_TIMESTAMP
+                WHERE id = ?
+            `), cid, current.Id)
+		} else {
+			_, err = txn.ExecContext(ctx, txn.Rebind(`
+                UPDATE head SET cid = ?, note = ?, updated_at = CURRENT_TIMESTAMP
+                WHERE id = ?
+            `), cid, note, current.Id)
+		}
+		if err != nil {
+			return err
+		}
+
+		if current.CID == cid {
+			return nil
+		}
+	}
+
+	var prev sql.NullInt64
+	err = txn.GetContext(ctx, &prev, txn.Rebind(`
+        SELECT max(id) FROM history WHERE record_id = ?
+    `), current.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        INSERT INTO history (record_id, cid, prev) VALUES (?, ?, ?)
+    `), current.Id, cid, prev)
+	return err
+}
+
+// renameRecord leaves an alias with the old name so links keep working.
+// stars move along by themselves, their foreign key cascades on update.
+func renameRecord(ctx context.Context, txn *sqlx.Tx, owner, name, newName string) error {
+	var id int64
+	err := txn.GetContext(ctx, &id, txn.Rebind(`
+        SELECT id FROM head WHERE owner = ? AND name = ?
+    `), owner, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        DELETE FROM aliases WHERE owner = ? AND name = ?
+    `), owner, newName)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        UPDATE head SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+    `), newName, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        INSERT INTO aliases (owner, name, record_id) VALUES (?, ?, ?)
+    `), owner, name, id)
+	return err
+}
+
+// transferRecord gives a record to newOwner. history goes along since it
+// points to the record id, stars cascade like on renames and the old path
+// becomes an alias, as do the aliases the record already had.
+func transferRecord(ctx context.Context, txn *sqlx.Tx, owner, name, newOwner string) error {
+	var id int64
+	err := txn.GetContext(ctx, &id, txn.Rebind(`
+        SELECT id FROM head WHERE owner = ? AND name = ?
+    `), owner, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        DELETE FROM aliases WHERE owner = ? AND name = ?
+    `), newOwner, name)
+	if err != nil {
+		return err
+	}
+
+	// notes for the versions published so far are still theirs
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        UPDATE history SET author = ? WHERE record_id = ? AND author = ''
+    `), owner, id)
+	if err != nil {
+		return err
+	}
+
+	// it was featured by the previous owner, not by the new one
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        UPDATE head SET owner = ?, pinned = false, updated_at = CURRENT_TIMESTAMP
+        WHERE id = ?
+    `), newOwner, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        INSERT INTO aliases (owner, name, record_id) VALUES (?, ?, ?)
+    `), owner, name, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, txn.Rebind(`
+        DELETE FROM transfers WHERE record_id = ?
+    `), id)
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// measuredStorage records how long each storage operation takes.
+type measuredStorage struct {
+	Storage
+	metrics *Metrics
+}
+
+func (m measuredStorage) observe(op string, start time.Time) {
+	m.metrics.queryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (m measuredStorage) CreateUser(ctx context.Context, name, email, pk, verificationToken string) error {
+	defer m.observe("create_user", time.Now())
+	return m.Storage.CreateUser(ctx, name, email, pk, verificationToken)
+}
+
+func (m measuredStorage) GetAccount(ctx context.Context, name string) (Account, error) {
+	defer m.observe("get_account", time.Now())
+	return m.Storage.GetAccount(ctx, name)
+}
+
+func (m measuredStorage) VerifyEmail(ctx context.Context, name, token string) (bool, error) {
+	defer m.observe("verify_email", time.Now())
+	return m.Storage.VerifyEmail(ctx, name, token)
+}
+
+func (m measuredStorage) GetUser(ctx context.Context, name string) (UserInfo, error) {
+	defer m.observe("get_user", time.Now())
+	return m.Storage.GetUser(ctx, name)
+}
+
+func (m measuredStorage) UserPublicKey(ctx context.Context, name string) (string, error) {
+	defer m.observe("user_public_key", time.Now())
+	return m.Storage.UserPublicKey(ctx, name)
+}
+
+func (m measuredStorage) UpdateUser(ctx context.Context, name string, fields map[string]interface{}) error {
+	defer m.observe("update_user", time.Now())
+	return m.Storage.UpdateUser(ctx, name, fields)
+}
+
+func (m measuredStorage) ListRecords(ctx context.Context, owner, tag string) ([]Entry, error) {
+	defer m.observe("list_records", time.Now())
+	return m.Storage.ListRecords(ctx, owner, tag)
+}
+
+func (m measuredStorage) GetRecord(ctx context.Context, owner, name string, full bool) (Entry, error) {
+	defer m.observe("get_record", time.Now())
+	return m.Storage.GetRecord(ctx, owner, name, full)
+}
+
+func (m measuredStorage) RecordCID(ctx context.Context, owner, name string) (string, error) {
+	defer m.observe("record_cid", time.Now())
+	return m.Storage.RecordCID(ctx, owner, name)
+}
+
+func (m measuredStorage) CountRecords(ctx context.Context, owner string) (int, error) {
+	defer m.observe("count_records", time.Now())
+	return m.Storage.CountRecords(ctx, owner)
+}
+
+func (m measuredStorage) SetRecord(ctx context.Context, owner, name, cid, note string) error {
+	defer m.observe("set_record", time.Now())
+	return m.Storage.SetRecord(ctx, owner, name, cid, note)
+}
+
+func (m measuredStorage) UpdateRecord(ctx context.Context, owner, name string, fields map[string]interface{}) error {
+	defer m.observe("update_record", time.Now())
+	return m.Storage.UpdateRecord(ctx, owner, name, fields)
+}
+
+func (m measuredStorage) DeleteRecord(ctx context.Context, owner, name string) ([]string, error) {
+	defer m.observe("delete_record", time.Now())
+	return m.Storage.DeleteRecord(ctx, owner, name)
+}
+
+func (m measuredStorage) QueryCID(ctx context.Context, cid, owner string) ([]HistoryEntry, error) {
+	defer m.observe("query_cid", time.Now())
+	return m.Storage.QueryCID(ctx, cid, owner)
+}
+
+func (m measuredStorage) RenameRecord(ctx context.Context, owner, name, newName string) error {
+	defer m.observe("rename_record", time.Now())
+	return m.Storage.RenameRecord(ctx, owner, name, newName)
+}
+
+func (m measuredStorage) AddAlias(ctx context.Context, owner, name, alias string) error {
+	defer m.observe("add_alias", time.Now())
+	return m.Storage.AddAlias(ctx, owner, name, alias)
+}
+
+func (m measuredStorage) RemoveAlias(ctx context.Context, owner, name, alias string) error {
+	defer m.observe("remove_alias", time.Now())
+	return m.Storage.RemoveAlias(ctx, owner, name, alias)
+}
+
+func (m measuredStorage) ResolveAlias(ctx context.Context, owner, alias string) (string, string, error) {
+	defer m.observe("resolve_alias", time.Now())
+	return m.Storage.ResolveAlias(ctx, owner, alias)
+}
+
+func (m measuredStorage) OfferTransfer(ctx context.Context, owner, name, recipient string) error {
+	defer m.observe("offer_transfer", time.Now())
+	return m.Storage.OfferTransfer(ctx, owner, name, recipient)
+}
+
+func (m measuredStorage) CancelTransfer(ctx context.Context, owner, name string) error {
+	defer m.observe("cancel_transfer", time.Now())
+	return m.Storage.CancelTransfer(ctx, owner, name)
+}
+
+func (m measuredStorage) GetTransfer(ctx context.Context, owner, name string) (string, error) {
+	defer m.observe("get_transfer", time.Now())
+	return m.Storage.GetTransfer(ctx, owner, name)
+}
+
+func (m measuredStorage) TransferRecord(ctx context.Context, owner, name, newOwner string) error {
+	defer m.observe("transfer_record", time.Now())
+	return m.Storage.TransferRecord(ctx, owner, name, newOwner)
+}
+
+func (m measuredStorage) Star(ctx context.Context, source, owner, name string) error {
+	defer m.observe("star", time.Now())
+	return m.Storage.Star(ctx, source, owner, name)
+}
+
+func (m measuredStorage) Unstar(ctx context.Context, source, owner, name string) error {
+	defer m.observe("unstar", time.Now())
+	return m.Storage.Unstar(ctx, source, owner, name)
+}
+
+func (m measuredStorage) AddFollower(ctx context.Context, owner string, follower Follower) (bool, error) {
+	defer m.observe("add_follower", time.Now())
+	return m.Storage.AddFollower(ctx, owner, follower)
+}
+
+func (m measuredStorage) RemoveFollower(ctx context.Context, owner, actor string) error {
+	defer m.observe("remove_follower", time.Now())
+	return m.Storage.RemoveFollower(ctx, owner, actor)
+}
+
+func (m measuredStorage) ListFollowers(ctx context.Context, owner string) ([]FollowerInfo, error) {
+	defer m.observe("list_followers", time.Now())
+	return m.Storage.ListFollowers(ctx, owner)
+}
+
+func (m measuredStorage) Stats(ctx context.Context) (Stats, error) {
+	defer m.observe("stats", time.Now())
+	return m.Storage.Stats(ctx)
+}
+
+func (m measuredStorage) ListAccounts(ctx context.Context) ([]Account, error) {
+	defer m.observe("list_accounts", time.Now())
+	return m.Storage.ListAccounts(ctx)
+}
+
+func (m measuredStorage) SuspendUser(ctx context.Context, name string, suspended bool, reason string) error {
+	defer m.observe("suspend_user", time.Now())
+	return m.Storage.SuspendUser(ctx, name, suspended, reason)
+}
+
+func (m measuredStorage) DeleteUser(ctx context.Context, name string) ([]Follower, error) {
+	defer m.observe("delete_user", time.Now())
+	return m.Storage.DeleteUser(ctx, name)
+}
+
+func (m measuredStorage) SetRecordState(ctx context.Context, owner, name, state, reason string) error {
+	defer m.observe("set_record_state", time.Now())
+	return m.Storage.SetRecordState(ctx, owner, name, state, reason)
+}
+
+func (m measuredStorage) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	defer m.observe("add_audit_entry", time.Now())
+	return m.Storage.AddAuditEntry(ctx, entry)
+}
+
+func (m measuredStorage) ListAuditLog(ctx context.Context, limit int) ([]AuditEntry, error) {
+	defer m.observe("list_audit_log", time.Now())
+	return m.Storage.ListAuditLog(ctx, limit)
+}
+
+func (m measuredStorage) AddReport(ctx context.Context, report Report) (int, error) {
+	defer m.observe("add_report", time.Now())
+	return m.Storage.AddReport(ctx, report)
+}
+
+func (m measuredStorage) GetReport(ctx context.Context, id int) (Report, error) {
+	defer m.observe("get_report", time.Now())
+	return m.Storage.GetReport(ctx, id)
+}
+
+func (m measuredStorage) ListReports(ctx context.Context, all bool) ([]Report, error) {
+	defer m.observe("list_reports", time.Now())
+	return m.Storage.ListReports(ctx, all)
+}
+
+func (m measuredStorage) ResolveReport(ctx context.Context, id int, admin, resolution string) error {
+	defer m.observe("resolve_report", time.Now())
+	return m.Storage.ResolveReport(ctx, id, admin, resolution)
+}
+
+func (m measuredStorage) ResolveRecordReports(ctx context.Context, owner, name, admin, resolution string) error {
+	defer m.observe("resolve_record_reports", time.Now())
+	return m.Storage.ResolveRecordReports(ctx, owner, name, admin, resolution)
+}
+
+func (m measuredStorage) DenyCID(ctx context.Context, cid, reason string) error {
+	defer m.observe("deny_cid", time.Now())
+	return m.Storage.DenyCID(ctx, cid, reason)
+}
+
+func (m measuredStorage) AllowCID(ctx context.Context, cid string) error {
+	defer m.observe("allow_cid", time.Now())
+	return m.Storage.AllowCID(ctx, cid)
+}
+
+func (m measuredStorage) IsCIDDenied(ctx context.Context, cid string) (bool, error) {
+	defer m.observe("is_cid_denied", time.Now())
+	return m.Storage.IsCIDDenied(ctx, cid)
+}
+
+func (m measuredStorage) ListDeniedCIDs(ctx context.Context) ([]DeniedCID, error) {
+	defer m.observe("list_denied_cids", time.Now())
+	return m.Storage.ListDeniedCIDs(ctx)
+}
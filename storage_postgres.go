@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type PostgresStorage struct {
+	db *sqlx.DB
+}
+
+func (p PostgresStorage) CreateUser(ctx context.Context, name, email, pk, verificationToken string) error {
+	_, err := p.db.ExecContext(ctx, `
+        INSERT INTO users (name, email, pk, verification_token)
+        VALUES ($1, $2, $3, $4)
+    `, name, email, pk, verificationToken)
+	return err
+}
+
+func (p PostgresStorage) GetAccount(ctx context.Context, name string) (account Account, err error) {
+	err = p.db.GetContext(ctx, &account, `
+        SELECT name, email, created_at, verified_at, suspended_at, suspension_reason
+        FROM users WHERE name = $1
+    `, name)
+	return
+}
+
+func (p PostgresStorage) VerifyEmail(ctx context.Context, name, token string) (bool, error) {
+	res, err := p.db.ExecContext(ctx, `
+        UPDATE users SET verified_at = now(), verification_token = ''
+        WHERE name = $1 AND verification_token = $2 AND verification_token != ''
+    `, name, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (p PostgresStorage) GetUser(ctx context.Context, name string) (userInfo UserInfo, err error) {
+	userInfo.Stars = []string{}
+	err = p.db.GetContext(ctx, &userInfo, `
+        SELECT name, string_agg(target_owner || '/' || target_name, ',') AS raw_stars
+        FROM users
+        LEFT OUTER JOIN stars ON stars.source = users.name
+        WHERE name = $1
+        GROUP BY name
+    `, name)
+	if userInfo.RawStars.Valid {
+		userInfo.Stars = strings.Split(userInfo.RawStars.String, ",")
+	}
+	return
+}
+
+func (p PostgresStorage) UserPublicKey(ctx context.Context, name string) (pk string, err error) {
+	err = p.db.GetContext(ctx, &pk, "SELECT pk FROM users WHERE name = $1", name)
+	return
+}
+
+func (p PostgresStorage) UpdateUser(ctx context.Context, name string, fields map[string]interface{}) error {
+	set, values, err := setClause(fields, UserFields)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.ExecContext(ctx, p.db.Rebind(`
+        UPDATE users SET `+set+`
+        WHERE name = ?
+    `), append(values, name)...)
+	return err
+}
+
+func (p PostgresStorage) ListRecords(ctx context.Context, owner, tag string) (entries []Entry, err error) {
+	if owner == "" {
+		// all records globally
+		err = p.db.SelectContext(ctx, &entries, `
+            SELECT
+              owner, name, cid, note,
+              count(stars) + (
+                SELECT count(*) FROM pub_likes WHERE record_id = head.id
+              ) AS nstars
+            FROM head
+            LEFT OUTER JOIN stars
+              ON target_owner = head.owner AND target_name = head.name
+            WHERE state = 'visible' AND ($1 = '' OR $1 = ANY(tags))
+            GROUP BY head.id, owner, name, cid, note, updated_at
+            ORDER BY updated_at DESC
+        `, tag)
+	} else {
+		// all records for just one user
+		err = p.db.SelectContext(ctx, &entries, `
+            SELECT
+              owner, name, cid, note,
+              count(stars) + (
+                SELECT count(*) FROM pub_likes WHERE record_id = head.id
+              ) AS nstars
+            FROM head
+            LEFT OUTER JOIN stars
+              ON target_owner = head.owner AND target_name = head.name
+            WHERE owner = $1 AND state = 'visible'
+            GROUP BY head.id, owner, name, cid, note, updated_at
+            ORDER BY updated_at DESC
+        `, owner)
+	}
+	return
+}
+
+func (p PostgresStorage) GetRecord(ctx context.Context, owner, name string, full bool) (entry Entry, err error) {
+	query := `
+        WITH st AS (
+          SELECT count(*) AS nstars FROM stars
+          WHERE target_owner = $1 AND target_name = $2
+        )
+        SELECT
+          owner, name, cid, note, pinned, tags, state, state_reason,
+          nstars + (
+            SELECT count(*) FROM pub_likes WHERE record_id = head.id
+          ) AS nstars,
+          (SELECT count(*) FROM pub_shares WHERE record_id = head.id) AS nshares
+        FROM head, st
+        WHERE owner = $1 AND name = $2
+    `
+	if full {
+		query = `
+            WITH df AS (
+              SELECT
+                id AS rid, owner, name, cid, note, body, pinned, tags,
+                state, state_reason
+              FROM head
+              WHERE owner = $1 AND name = $2
+            ), ph AS (
+              SELECT array_agg(cid || '|' || set_at ORDER BY id DESC) AS r
+              FROM history
+              WHERE record_id = (SELECT rid FROM df)
+            ), st AS (
+              SELECT count(*) AS nstars FROM stars
+              WHERE target_owner = $1 AND target_name = $2
+            )
+            SELECT
+              owner, name, cid, note, body, pinned, tags, state, state_reason,
+              array_to_string(r, '~') AS raw_history,
+              nstars + (
+                SELECT count(*) FROM pub_likes WHERE record_id = rid
+              ) AS nstars,
+              (SELECT count(*) FROM pub_shares WHERE record_id = rid) AS nshares
+            FROM df, ph, st;
+        `
+	}
+
+	err = p.db.GetContext(ctx, &entry, query, owner, name)
+	if err != nil {
+		return
+	}
+
+	if entry.RawHistory.Valid {
+		entry.History = parseRawHistory(entry.RawHistory.String)
+	}
+
+	if full {
+		// replies from the fediverse
+		entry.Comments = make([]Comment, 0)
+		err = p.db.SelectContext(ctx, &entry.Comments, `
+            SELECT author, url, content, published_at
+            FROM comments
+            INNER JOIN head ON comments.record_id = head.id
+            WHERE owner = $1 AND name = $2
+            ORDER BY published_at
+        `, owner, name)
+	}
+	return
+}
+
+func (p PostgresStorage) RecordCID(ctx context.Context, owner, name string) (cid string, err error) {
+	err = p.db.GetContext(ctx, &cid, `
+        SELECT cid FROM head
+        WHERE owner = $1 AND name = $2
+    `, owner, name)
+	return
+}
+
+func (p PostgresStorage) CountRecords(ctx context.Context, owner string) (n int, err error) {
+	err = p.db.GetContext(ctx, &n, `SELECT count(*) FROM head WHERE owner = $1`, owner)
+	return
+}
+
+func (p PostgresStorage) SetRecord(ctx context.Context, owner, name, cid, note string) error {
+	txn, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := setRecord(ctx, txn, owner, name, cid, note); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (p PostgresStorage) UpdateRecord(ctx context.Context, owner, name string, fields map[string]interface{}) error {
+	set, values, err := setClause(fields, RecordFields)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.ExecContext(ctx, p.db.Rebind(`
+        UPDATE head SET `+set+`
+        WHERE owner = ? AND name = ?
+    `), append(values, owner, name)...)
+	return err
+}
+
+// DeleteRecord also keeps tombstones for the notes that were published from
+// the record, since its history is deleted along with it.
+func (p PostgresStorage) DeleteRecord(ctx context.Context, owner, name string) (noteIds []string, err error) {
+	txn, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	err = txn.SelectContext(ctx, &noteIds, `
+        INSERT INTO pub_tombstones (id, owner)
+        SELECT history.id, coalesce(nullif(author, ''), owner)
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE owner = $1 AND name = $2
+        RETURNING id::text
+    `, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// stars point to the record by name, they don't go away by themselves
+	_, err = txn.ExecContext(ctx, `
+        DELETE FROM stars
+        WHERE target_owner = $1 AND target_name = $2
+    `, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = txn.ExecContext(ctx, `
+        DELETE FROM head
+        WHERE owner = $1 AND name = $2
+    `, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return noteIds, txn.Commit()
+}
+
+func (p PostgresStorage) RenameRecord(ctx context.Context, owner, name, newName string) error {
+	txn, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := renameRecord(ctx, txn, owner, name, newName); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (p PostgresStorage) QueryCID(ctx context.Context, cid, owner string) (entries []HistoryEntry, err error) {
+	match := ""
+	args := []interface{}{cid}
+	if owner != "" {
+		// just for one owner
+		match += `AND head.owner = $2 `
+		args = append(args, owner)
+	}
+
+	err = p.db.SelectContext(ctx, &entries, `
+        SELECT owner, name, set_at, history.cid, (
+          SELECT count(*) FROM history AS hc
+          WHERE hc.record_id = history.record_id
+            AND hc.set_at > history.set_at
+        ) AS nseq
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE history.cid = $1 AND state = 'visible' `+match+`
+        ORDER BY updated_at DESC
+    `, args...)
+	return
+}
+
+func (p PostgresStorage) Star(ctx context.Context, source, owner, name string) error {
+	_, err := p.db.ExecContext(ctx, `
+        INSERT INTO stars (source, target_owner, target_name)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (source, target_owner, target_name) DO NOTHING
+    `, source, owner, name)
+	return err
+}
+
+func (p PostgresStorage) Unstar(ctx context.Context, source, owner, name string) error {
+	_, err := p.db.ExecContext(ctx, `
+        DELETE FROM stars
+        WHERE source = $1
+          AND target_owner = $2 AND target_name = $3
+    `, source, owner, name)
+	return err
+}
+
+// AddFollower adds a follower as pending if owner approves followers
+// manually, unless it was already an accepted follower.
+func (p PostgresStorage) AddFollower(ctx context.Context, owner string, f Follower) (pending bool, err error) {
+	err = p.db.GetContext(ctx, &pending, `
+        INSERT INTO pub_user_followers
+          (follower, target, inbox, shared_inbox, follow_id, pending)
+        VALUES ($1, $2, $3, $4, $5, (
+          SELECT manually_approves_followers FROM users WHERE name = $2
+        ))
+        ON CONFLICT (follower, target) DO
+        UPDATE SET inbox = $3, shared_inbox = $4, follow_id = $5,
+          pending = pub_user_followers.pending AND EXCLUDED.pending
+        RETURNING pending
+    `, f.Actor, owner, f.Inbox, f.SharedInbox, f.FollowId)
+	return
+}
+
+func (p PostgresStorage) RemoveFollower(ctx context.Context, owner, actor string) error {
+	_, err := p.db.ExecContext(ctx, `
+        DELETE FROM pub_user_followers
+        WHERE follower = $1 AND target = $2
+    `, actor, owner)
+	return err
+}
+
+func (p PostgresStorage) ListFollowers(ctx context.Context, owner string) (followers []FollowerInfo, err error) {
+	followers = make([]FollowerInfo, 0)
+	err = p.db.SelectContext(ctx, &followers, `
+        SELECT follower, pending
+        FROM pub_user_followers
+        WHERE target = $1
+        ORDER BY pending DESC, follower
+    `, owner)
+	return
+}
+
+func (p PostgresStorage) Stats(ctx context.Context) (stats Stats, err error) {
+	err = p.db.GetContext(ctx, &stats, `
+        SELECT
+          (SELECT count(*) FROM users) AS users,
+          (SELECT count(*) FROM head) AS records
+    `)
+	return
+}
+
+func (p PostgresStorage) ListAccounts(ctx context.Context) (accounts []Account, err error) {
+	accounts = make([]Account, 0)
+	err = p.db.SelectContext(ctx, &accounts, `
+        SELECT
+          name, email, created_at, verified_at, suspended_at, suspension_reason,
+          (SELECT count(*) FROM head WHERE owner = users.name) AS nrecords
+        FROM users
+        ORDER BY created_at DESC
+    `)
+	return
+}
+
+func (p PostgresStorage) SuspendUser(ctx context.Context, name string, suspended bool, reason string) error {
+	_, err := p.db.ExecContext(ctx, `
+        UPDATE users SET
+          suspended_at = CASE WHEN $2 THEN now() END,
+          suspension_reason = $3
+        WHERE name = $1
+    `, name, suspended, reason)
+	return err
+}
+
+// DeleteUser removes a user and everything that belongs to them, keeping
+// tombstones for the notes published from their records. their actor key
+// is kept so the Delete for the actor can be signed, it goes to the
+// followers that are returned.
+func (p PostgresStorage) DeleteUser(ctx context.Context, name string) (followers []Follower, err error) {
+	txn, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	err = txn.SelectContext(ctx, &followers, `
+        DELETE FROM pub_user_followers WHERE target = $1
+        RETURNING follower, inbox, shared_inbox, follow_id
+    `, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, query := range []string{`
+        INSERT INTO pub_tombstones (id, owner)
+        SELECT history.id, coalesce(nullif(author, ''), owner)
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE owner = $1
+        ON CONFLICT (id) DO NOTHING
+    `, `
+        INSERT INTO pub_deleted_actors (name, actor_sk)
+        SELECT name, actor_sk FROM users WHERE name = $1 AND actor_sk != ''
+        ON CONFLICT (name) DO UPDATE SET
+          actor_sk = excluded.actor_sk, deleted_at = now()
+    `,
+		// nothing they sent before matters anymore
+		`DELETE FROM pub_deliveries WHERE sender = $1`,
+		`DELETE FROM transfers WHERE recipient = $1
+           OR record_id IN (SELECT id FROM head WHERE owner = $1)`,
+		`DELETE FROM comments WHERE record_id IN (SELECT id FROM head WHERE owner = $1)`,
+		`DELETE FROM pub_likes WHERE record_id IN (SELECT id FROM head WHERE owner = $1)`,
+		`DELETE FROM pub_shares WHERE record_id IN (SELECT id FROM head WHERE owner = $1)`,
+		`DELETE FROM stars WHERE source = $1 OR target_owner = $1`,
+		`DELETE FROM pub_following WHERE owner = $1`,
+		`DELETE FROM timeline WHERE owner = $1`,
+		`DELETE FROM pub_blocks WHERE owner = $1`,
+		`DELETE FROM head WHERE owner = $1`,
+		`DELETE FROM users WHERE name = $1`,
+	} {
+		if _, err := txn.ExecContext(ctx, query, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return followers, txn.Commit()
+}
+
+// SetRecordState also keeps the denylist in sync: the cid of a record taken
+// down is denied until the record is visible again.
+func (p PostgresStorage) SetRecordState(ctx context.Context, owner, name, state, reason string) error {
+	txn, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	var id int
+	err = txn.GetContext(ctx, &id, `
+        UPDATE head SET state = $3, state_reason = $4
+        WHERE owner = $1 AND name = $2
+        RETURNING id
+    `, owner, name, state, reason)
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case RecordTakenDown:
+		_, err = txn.ExecContext(ctx, `
+            INSERT INTO denied_cids (cid, record_id, reason)
+            SELECT cid, id, owner || '/' || name || ': ' || $2 FROM head WHERE id = $1
+            ON CONFLICT (cid, record_id) DO UPDATE SET reason = excluded.reason
+        `, id, reason)
+	case RecordVisible:
+		_, err = txn.ExecContext(ctx, `DELETE FROM denied_cids WHERE record_id = $1`, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+func (p PostgresStorage) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	_, err := p.db.ExecContext(ctx, `
+        INSERT INTO audit_log (admin, action, target, reason)
+        VALUES ($1, $2, $3, $4)
+    `, entry.Admin, entry.Action, entry.Target, entry.Reason)
+	return err
+}
+
+func (p PostgresStorage) ListAuditLog(ctx context.Context, limit int) (entries []AuditEntry, err error) {
+	entries = make([]AuditEntry, 0)
+	err = p.db.SelectContext(ctx, &entries, `
+        SELECT id, admin, action, target, reason, created_at
+        FROM audit_log
+        ORDER BY id DESC
+        LIMIT $1
+    `, limit)
+	return
+}
+
+func (p PostgresStorage) AddReport(ctx context.Context, report Report) (id int, err error) {
+	err = p.db.GetContext(ctx, &id, `
+        INSERT INTO reports (owner, name, cid, category, description, contact)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id
+    `, report.Owner, report.Name, report.CID, report.Category,
+		report.Description, report.Contact)
+	return
+}
+
+func (p PostgresStorage) GetReport(ctx context.Context, id int) (report Report, err error) {
+	err = p.db.GetContext(ctx, &report, `
+        SELECT * FROM reports WHERE id = $1
+    `, id)
+	return
+}
+
+func (p PostgresStorage) ListReports(ctx context.Context, all bool) (reports []Report, err error) {
+	reports = make([]Report, 0)
+	err = p.db.SelectContext(ctx, &reports, `
+        SELECT * FROM reports
+        WHERE $1 OR resolved_at IS NULL
+        ORDER BY id DESC
+        LIMIT 500
+    `, all)
+	return
+}
+
+func (p PostgresStorage) ResolveReport(ctx context.Context, id int, admin, resolution string) error {
+	res, err := p.db.ExecContext(ctx, `
+        UPDATE reports SET resolved_at = now(), resolved_by = $2, resolution = $3
+        WHERE id = $1 AND resolved_at IS NULL
+    `, id, admin, resolution)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (p PostgresStorage) ResolveRecordReports(ctx context.Context, owner, name, admin, resolution string) error {
+	_, err := p.db.ExecContext(ctx, `
+        UPDATE reports SET resolved_at = now(), resolved_by = $3, resolution = $4
+        WHERE owner = $1 AND name = $2 AND resolved_at IS NULL
+    `, owner, name, admin, resolution)
+	return err
+}
+
+func (p PostgresStorage) DenyCID(ctx context.Context, cid, reason string) error {
+	_, err := p.db.ExecContext(ctx, `
+        INSERT INTO denied_cids (cid, reason) VALUES ($1, $2)
+        ON CONFLICT (cid, record_id) DO UPDATE SET reason = $2
+    `, cid, reason)
+	return err
+}
+
+func (p PostgresStorage) AllowCID(ctx context.Context, cid string) error {
+	_, err := p.db.ExecContext(ctx, `
+        DELETE FROM denied_cids WHERE cid = $1 AND record_id = 0
+    `, cid)
+	return err
+}
+
+func (p PostgresStorage) IsCIDDenied(ctx context.Context, cid string) (denied bool, err error) {
+	err = p.db.GetContext(ctx, &denied, `
+        SELECT count(*) > 0 FROM denied_cids WHERE cid = $1
+    `, cid)
+	return
+}
+
+func (p PostgresStorage) ListDeniedCIDs(ctx context.Context) (cids []DeniedCID, err error) {
+	cids = make([]DeniedCID, 0)
+	err = p.db.SelectContext(ctx, &cids, `
+        SELECT cid, reason, created_at FROM denied_cids ORDER BY created_at DESC
+    `)
+	return
+}
+
+// AddAlias points alias to the record, even if it pointed to another one.
+func (p PostgresStorage) AddAlias(ctx context.Context, owner, name, alias string) error {
+	res, err := p.db.ExecContext(ctx, `
+        INSERT INTO aliases (owner, name, record_id)
+        SELECT owner, $3, id FROM head WHERE owner = $1 AND name = $2
+        ON CONFLICT (owner, name) DO UPDATE SET record_id = excluded.record_id
+    `, owner, name, alias)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (p PostgresStorage) RemoveAlias(ctx context.Context, owner, name, alias string) error {
+	res, err := p.db.ExecContext(ctx, `
+        DELETE FROM aliases
+        WHERE owner = $1 AND name = $3 AND record_id = (
+          SELECT id FROM head WHERE owner = $1 AND name = $2
+        )
+    `, owner, name, alias)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ResolveAlias finds where a record is now, it may have changed owners.
+func (p PostgresStorage) ResolveAlias(ctx context.Context, owner, alias string) (newOwner, name string, err error) {
+	row := p.db.QueryRowContext(ctx, `
+        SELECT head.owner, head.name FROM aliases
+        INNER JOIN head ON head.id = aliases.record_id
+        WHERE aliases.owner = $1 AND aliases.name = $2
+    `, owner, alias)
+	err = row.Scan(&newOwner, &name)
+	return
+}
+
+// OfferTransfer replaces any transfer already waiting for the record.
+func (p PostgresStorage) OfferTransfer(ctx context.Context, owner, name, recipient string) error {
+	res, err := p.db.ExecContext(ctx, `
+        INSERT INTO transfers (record_id, recipient)
+        SELECT id, $3 FROM head WHERE owner = $1 AND name = $2
+        ON CONFLICT (record_id) DO UPDATE
+          SET recipient = excluded.recipient, created_at = excluded.created_at
+    `, owner, name, recipient)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (p PostgresStorage) CancelTransfer(ctx context.Context, owner, name string) error {
+	res, err := p.db.ExecContext(ctx, `
+        DELETE FROM transfers
+        WHERE record_id = (SELECT id FROM head WHERE owner = $1 AND name = $2)
+    `, owner, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (p PostgresStorage) GetTransfer(ctx context.Context, owner, name string) (recipient string, err error) {
+	err = p.db.GetContext(ctx, &recipient, `
+        SELECT recipient FROM transfers
+        INNER JOIN head ON head.id = transfers.record_id
+        WHERE owner = $1 AND name = $2
+    `, owner, name)
+	return
+}
+
+func (p PostgresStorage) TransferRecord(ctx context.Context, owner, name, newOwner string) error {
+	txn, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := transferRecord(ctx, txn, owner, name, newOwner); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStorage keeps everything in a single file, for small instances and
+// for tests. tags are stored as text in the postgres array format so they
+// can be read with the same pq.StringArray.
+type SQLiteStorage struct {
+	db *sqlx.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+  name text PRIMARY KEY,
+  email text NOT NULL,
+  pk text,
+  actor_sk text NOT NULL DEFAULT '',
+  manually_approves_followers boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS head (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  owner text NOT NULL REFERENCES users (name),
+  name text NOT NULL,
+  cid text NOT NULL,
+  updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  note text NOT NULL DEFAULT '' CHECK (length(note) <= 280),
+  body text NOT NULL DEFAULT '',
+  pinned boolean NOT NULL DEFAULT false,
+  tags text NOT NULL DEFAULT '{}',
+
+  UNIQUE (owner, name),
+  CHECK (length(owner) <= 35),
+  CHECK (length(name) <= 50)
+);
+
+CREATE INDEX IF NOT EXISTS head_cid_idx ON head (cid);
+
+CREATE TABLE IF NOT EXISTS history (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  record_id integer NOT NULL REFERENCES head (id) ON DELETE CASCADE,
+  set_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  cid text NOT NULL,
+  media_type text NOT NULL DEFAULT '',
+  prev integer
+);
+
+CREATE INDEX IF NOT EXISTS history_record_id_idx ON history (record_id);
+CREATE INDEX IF NOT EXISTS history_cid_idx ON history (cid);
+
+CREATE TABLE IF NOT EXISTS stars (
+  source text NOT NULL REFERENCES users (name),
+  target_owner text NOT NULL,
+  target_name text NOT NULL,
+  starred_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  FOREIGN KEY (target_owner, target_name) REFERENCES head (owner, name),
+  UNIQUE (source, target_owner, target_name)
+);
+
+CREATE TABLE IF NOT EXISTS pub_user_followers (
+  follower text NOT NULL,
+  target text NOT NULL REFERENCES users (name),
+  inbox text NOT NULL DEFAULT '',
+  shared_inbox text NOT NULL DEFAULT '',
+  follow_id text NOT NULL DEFAULT '',
+  pending boolean NOT NULL DEFAULT false,
+
+  UNIQUE (follower, target)
+);
+`
+
+// sqliteUpgrades are applied in order after sqliteSchema, the ones already
+// applied are tracked by sqlite's user_version.
+var sqliteUpgrades = []string{
+	// email verification, existing users are considered verified
+	`
+ALTER TABLE users ADD COLUMN created_at timestamp;
+ALTER TABLE users ADD COLUMN verified_at timestamp;
+ALTER TABLE users ADD COLUMN verification_token text NOT NULL DEFAULT '';
+UPDATE users SET created_at = CURRENT_TIMESTAMP, verified_at = CURRENT_TIMESTAMP;
+`,
+	// moderation
+	`
+ALTER TABLE users ADD COLUMN suspended_at timestamp;
+ALTER TABLE users ADD COLUMN suspension_reason text NOT NULL DEFAULT '';
+ALTER TABLE head ADD COLUMN state text NOT NULL DEFAULT 'visible'
+  CHECK (state IN ('visible', 'hidden', 'taken_down'));
+ALTER TABLE head ADD COLUMN state_reason text NOT NULL DEFAULT '';
+
+CREATE TABLE audit_log (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  admin text NOT NULL,
+  action text NOT NULL,
+  target text NOT NULL,
+  reason text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`,
+	// reports and the cid denylist
+	`
+CREATE TABLE reports (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  owner text NOT NULL,
+  name text NOT NULL,
+  cid text NOT NULL DEFAULT '',
+  category text NOT NULL,
+  description text NOT NULL DEFAULT '',
+  contact text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  resolved_at timestamp,
+  resolved_by text NOT NULL DEFAULT '',
+  resolution text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE denied_cids (
+  cid text PRIMARY KEY,
+  reason text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT OR IGNORE INTO denied_cids (cid, reason)
+SELECT cid, state_reason FROM head WHERE state = 'taken_down';
+`,
+	// aliases, and stars following renamed records. sqlite can't change
+	// a foreign key so the stars table is rebuilt.
+	`
+CREATE TABLE stars_new (
+  source text NOT NULL REFERENCES users (name),
+  target_owner text NOT NULL,
+  target_name text NOT NULL,
+  starred_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  FOREIGN KEY (target_owner, target_name) REFERENCES head (owner, name)
+    ON UPDATE CASCADE,
+  UNIQUE (source, target_owner, target_name)
+);
+INSERT INTO stars_new SELECT source, target_owner, target_name, starred_at FROM stars;
+DROP TABLE stars;
+ALTER TABLE stars_new RENAME TO stars;
+
+CREATE TABLE aliases (
+  owner text NOT NULL,
+  name text NOT NULL,
+  record_id integer NOT NULL REFERENCES head (id) ON DELETE CASCADE,
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (owner, name),
+  CHECK (length(name) <= 50)
+);
+CREATE INDEX aliases_record_id_idx ON aliases (record_id);
+`,
+	// record transfers waiting for the recipient
+	`
+CREATE TABLE transfers (
+  record_id integer PRIMARY KEY REFERENCES head (id) ON DELETE CASCADE,
+  recipient text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`,
+	// a cid can be denied by an admin and by each record taken down with
+	// it, record_id is 0 for denials added by hand.
+	`
+CREATE TABLE denied_cids_new (
+  cid text NOT NULL,
+  record_id integer NOT NULL DEFAULT 0,
+  reason text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (cid, record_id)
+);
+INSERT INTO denied_cids_new (cid, record_id, reason, created_at)
+SELECT cid, coalesce((
+  SELECT id FROM head
+  WHERE head.cid = denied_cids.cid AND state = 'taken_down'
+    AND denied_cids.reason LIKE owner || '/' || name || ': %'
+), 0), reason, created_at
+FROM denied_cids;
+DROP TABLE denied_cids;
+ALTER TABLE denied_cids_new RENAME TO denied_cids;
+`,
+	// who published each version when it isn't the record owner anymore
+	`
+ALTER TABLE history ADD COLUMN author text NOT NULL DEFAULT '';
+`,
+}
+
+func sqliteMigrate(db *sqlx.DB) error {
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.Get(&version, "PRAGMA user_version"); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteUpgrades); i++ {
+		txn, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		_, err = txn.Exec(sqliteUpgrades[i])
+		if err == nil {
+			_, err = txn.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q SQLiteStorage) CreateUser(ctx context.Context, name, email, pk, verificationToken string) error {
+	_, err := q.db.ExecContext(ctx, `
+        INSERT INTO users (name, email, pk, verification_token, created_at)
+        VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+    `, name, email, pk, verificationToken)
+	return err
+}
+
+func (q SQLiteStorage) GetAccount(ctx context.Context, name string) (account Account, err error) {
+	err = q.db.GetContext(ctx, &account, `
+        SELECT name, email, created_at, verified_at, suspended_at, suspension_reason
+        FROM users WHERE name = ?
+    `, name)
+	return
+}
+
+func (q SQLiteStorage) VerifyEmail(ctx context.Context, name, token string) (bool, error) {
+	res, err := q.db.ExecContext(ctx, `
+        UPDATE users SET verified_at = CURRENT_TIMESTAMP, verification_token = ''
+        WHERE name = ? AND verification_token = ? AND verification_token != ''
+    `, name, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (q SQLiteStorage) GetUser(ctx context.Context, name string) (userInfo UserInfo, err error) {
+	userInfo.Stars = []string{}
+	err = q.db.GetContext(ctx, &userInfo, `
+        SELECT name, group_concat(target_owner || '/' || target_name, ',') AS raw_stars
+        FROM users
+        LEFT OUTER JOIN stars ON stars.source = users.name
+        WHERE name = ?
+        GROUP BY name
+    `, name)
+	if userInfo.RawStars.Valid {
+		userInfo.Stars = strings.Split(userInfo.RawStars.String, ",")
+	}
+	return
+}
+
+func (q SQLiteStorage) UserPublicKey(ctx context.Context, name string) (pk string, err error) {
+	err = q.db.GetContext(ctx, &pk, "SELECT pk FROM users WHERE name = ?", name)
+	return
+}
+
+func (q SQLiteStorage) UpdateUser(ctx context.Context, name string, fields map[string]interface{}) error {
+	set, values, err := setClause(fields, UserFields)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.db.ExecContext(ctx, `
+        UPDATE users SET `+set+`
+        WHERE name = ?
+    `, append(values, name)...)
+	return err
+}
+
+func (q SQLiteStorage) ListRecords(ctx context.Context, owner, tag string) (entries []Entry, err error) {
+	if owner == "" {
+		// all records globally
+		err = q.db.SelectContext(ctx, &entries, `
+            SELECT owner, name, cid, note, count(stars.source) AS nstars
+            FROM head
+            LEFT OUTER JOIN stars
+              ON target_owner = head.owner AND target_name = head.name
+            WHERE state = 'visible' AND (? = '' OR instr(tags, '"' || ? || '"') > 0)
+            GROUP BY head.id
+            ORDER BY updated_at DESC
+        `, tag, tag)
+	} else {
+		// all records for just one user
+		err = q.db.SelectContext(ctx, &entries, `
+            SELECT owner, name, cid, note, count(stars.source) AS nstars
+            FROM head
+            LEFT OUTER JOIN stars
+              ON target_owner = head.owner AND target_name = head.name
+            WHERE owner = ? AND state = 'visible'
+            GROUP BY head.id
+            ORDER BY updated_at DESC
+        `, owner)
+	}
+	return
+}
+
+func (q SQLiteStorage) GetRecord(ctx context.Context, owner, name string, full bool) (entry Entry, err error) {
+	err = q.db.GetContext(ctx, &entry, `
+        SELECT
+          owner, name, cid, note, body, pinned, tags, state, state_reason,
+          (
+            SELECT count(*) FROM stars
+            WHERE target_owner = head.owner AND target_name = head.name
+          ) AS nstars
+        FROM head
+        WHERE owner = ? AND name = ?
+    `, owner, name)
+	if err != nil {
+		return
+	}
+
+	if !full {
+		entry.Body = ""
+		return
+	}
+
+	err = q.db.SelectContext(ctx, &entry.History, `
+        SELECT history.cid, set_at
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE owner = ? AND name = ?
+        ORDER BY history.id DESC
+    `, owner, name)
+	entry.Comments = make([]Comment, 0)
+	return
+}
+
+func (q SQLiteStorage) RecordCID(ctx context.Context, owner, name string) (cid string, err error) {
+	err = q.db.GetContext(ctx, &cid, `
+        SELECT cid FROM head
+        WHERE owner = ? AND name = ?
+    `, owner, name)
+	return
+}
+
+func (q SQLiteStorage) CountRecords(ctx context.Context, owner string) (n int, err error) {
+	err = q.db.GetContext(ctx, &n, `SELECT count(*) FROM head WHERE owner = ?`, owner)
+	return
+}
+
+func (q SQLiteStorage) SetRecord(ctx context.Context, owner, name, cid, note string) error {
+	txn, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := setRecord(ctx, txn, owner, name, cid, note); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (q SQLiteStorage) UpdateRecord(ctx context.Context, owner, name string, fields map[string]interface{}) error {
+	set, values, err := setClause(fields, RecordFields)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.db.ExecContext(ctx, `
+        UPDATE head SET `+set+`
+        WHERE owner = ? AND name = ?
+    `, append(values, owner, name)...)
+	return err
+}
+
+// DeleteRecord doesn't keep tombstones as there is no ActivityPub here.
+func (q SQLiteStorage) DeleteRecord(ctx context.Context, owner, name string) ([]string, error) {
+	txn, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	// stars point to the record by name, they don't go away by themselves
+	_, err = txn.ExecContext(ctx, `
+        DELETE FROM stars
+        WHERE target_owner = ? AND target_name = ?
+    `, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = txn.ExecContext(ctx, `
+        DELETE FROM head
+        WHERE owner = ? AND name = ?
+    `, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	return nil, txn.Commit()
+}
+
+func (q SQLiteStorage) RenameRecord(ctx context.Context, owner, name, newName string) error {
+	txn, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := renameRecord(ctx, txn, owner, name, newName); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (q SQLiteStorage) QueryCID(ctx context.Context, cid, owner string) (entries []HistoryEntry, err error) {
+	err = q.db.SelectContext(ctx, &entries, `
+        SELECT owner, name, set_at, history.cid, (
+          SELECT count(*) FROM history AS hc
+          WHERE hc.record_id = history.record_id
+            AND hc.set_at > history.set_at
+        ) AS nseq
+        FROM history
+        INNER JOIN head ON history.record_id = head.id
+        WHERE history.cid = ? AND (? = '' OR head.owner = ?) AND state = 'visible'
+        ORDER BY updated_at DESC
+    `, cid, owner, owner)
+	return
+}
+
+func (q SQLiteStorage) Star(ctx context.Context, source, owner, name string) error {
+	_, err := q.db.ExecContext(ctx, `
+        INSERT OR IGNORE INTO stars (source, target_owner, target_name)
+        VALUES (?, ?, ?)
+    `, source, owner, name)
+	return err
+}
+
+func (q SQLiteStorage) Unstar(ctx context.Context, source, owner, name string) error {
+	_, err := q.db.ExecContext(ctx, `
+        DELETE FROM stars
+        WHERE source = ?
+          AND target_owner = ? AND target_name = ?
+    `, source, owner, name)
+	return err
+}
+
+func (q SQLiteStorage) AddFollower(ctx context.Context, owner string, f Follower) (pending bool, err error) {
+	txn, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.ExecContext(ctx, `
+        INSERT INTO pub_user_followers
+          (follower, target, inbox, shared_inbox, follow_id, pending)
+        VALUES (?, ?, ?, ?, ?, (
+          SELECT manually_approves_followers FROM users WHERE name = ?
+        ))
+        ON CONFLICT (follower, target) DO
+        UPDATE SET inbox = excluded.inbox, shared_inbox = excluded.shared_inbox,
+          follow_id = excluded.follow_id,
+          pending = pub_user_followers.pending AND excluded.pending
+    `, f.Actor, owner, f.Inbox, f.SharedInbox, f.FollowId, owner)
+	if err != nil {
+		return false, err
+	}
+
+	err = txn.GetContext(ctx, &pending, `
+        SELECT pending FROM pub_user_followers
+        WHERE follower = ? AND target = ?
+    `, f.Actor, owner)
+	if err != nil {
+		return false, err
+	}
+
+	return pending, txn.Commit()
+}
+
+func (q SQLiteStorage) RemoveFollower(ctx context.Context, owner, actor string) error {
+	_, err := q.db.ExecContext(ctx, `
+        DELETE FROM pub_user_followers
+        WHERE follower = ? AND target = ?
+    `, actor, owner)
+	return err
+}
+
+func (q SQLiteStorage) ListFollowers(ctx context.Context, owner string) (followers []FollowerInfo, err error) {
+	followers = make([]FollowerInfo, 0)
+	err = q.db.SelectContext(ctx, &followers, `
+        SELECT follower, pending
+        FROM pub_user_followers
+        WHERE target = ?
+        ORDER BY pending DESC, follower
+    `, owner)
+	return
+}
+
+func (q SQLiteStorage) Stats(ctx context.Context) (stats Stats, err error) {
+	err = q.db.GetContext(ctx, &stats, `
+        SELECT
+          (SELECT count(*) FROM users) AS users,
+          (SELECT count(*) FROM head) AS records
+    `)
+	return
+}
+
+func (q SQLiteStorage) ListAccounts(ctx context.Context) (accounts []Account, err error) {
+	accounts = make([]Account, 0)
+	err = q.db.SelectContext(ctx, &accounts, `
+        SELECT
+          name, email, created_at, verified_at, suspended_at, suspension_reason,
+          (SELECT count(*) FROM head WHERE owner = users.name) AS nrecords
+        FROM users
+        ORDER BY created_at DESC
+    `)
+	return
+}
+
+func (q SQLiteStorage) SuspendUser(ctx context.Context, name string, suspended bool, reason string) error {
+	_, err := q.db.ExecContext(ctx, `
+        UPDATE users SET
+          suspended_at = CASE WHEN ? THEN CURRENT_TIMESTAMP END,
+          suspension_reason = ?
+        WHERE name = ?
+    `, suspended, reason, name)
+	return err
+}
+
+// DeleteUser removes a user and everything that belongs to them.
+func (q SQLiteStorage) DeleteUser(ctx context.Context, name string) ([]Follower, error) {
+	txn, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM stars WHERE source = ?1 OR target_owner = ?1`,
+		`DELETE FROM pub_user_followers WHERE target = ?1`,
+		`DELETE FROM head WHERE owner = ?1`,
+		`DELETE FROM users WHERE name = ?1`,
+	} {
+		if _, err := txn.ExecContext(ctx, query, name); err != nil {
+			return nil, err
+		}
+	}
+
+	// there is no federation here, nobody to tell
+	return nil, txn.Commit()
+}
+
+// SetRecordState also keeps the denylist in sync: the cid of a record taken
+// down is denied until the record is visible again.
+func (q SQLiteStorage) SetRecordState(ctx context.Context, owner, name, state, reason string) error {
+	txn, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	var id int
+	err = txn.GetContext(ctx, &id, `
+        SELECT id FROM head WHERE owner = ? AND name = ?
+    `, owner, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, `
+        UPDATE head SET state = ?, state_reason = ? WHERE id = ?
+    `, state, reason, id)
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case RecordTakenDown:
+		_, err = txn.ExecContext(ctx, `
+            INSERT INTO denied_cids (cid, record_id, reason)
+            SELECT cid, id, owner || '/' || name || ': ' || ?2 FROM head WHERE id = ?1
+            ON CONFLICT (cid, record_id) DO UPDATE SET reason = excluded.reason
+        `, id, reason)
+	case RecordVisible:
+		_, err = txn.ExecContext(ctx, `DELETE FROM denied_cids WHERE record_id = ?`, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+func (q SQLiteStorage) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	_, err := q.db.ExecContext(ctx, `
+        INSERT INTO audit_log (admin, action, target, reason)
+        VALUES (?, ?, ?, ?)
+    `, entry.Admin, entry.Action, entry.Target, entry.Reason)
+	return err
+}
+
+func (q SQLiteStorage) ListAuditLog(ctx context.Context, limit int) (entries []AuditEntry, err error) {
+	entries = make([]AuditEntry, 0)
+	err = q.db.SelectContext(ctx, &entries, `
+        SELECT id, admin, action, target, reason, created_at
+        FROM audit_log
+        ORDER BY id DESC
+        LIMIT ?
+    `, limit)
+	return
+}
+
+func (q SQLiteStorage) AddReport(ctx context.Context, report Report) (id int, err error) {
+	res, err := q.db.ExecContext(ctx, `
+        INSERT INTO reports (owner, name, cid, category, description, contact)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, report.Owner, report.Name, report.CID, report.Category,
+		report.Description, report.Contact)
+	if err != nil {
+		return 0, err
+	}
+	lastId, err := res.LastInsertId()
+	return int(lastId), err
+}
+
+func (q SQLiteStorage) GetReport(ctx context.Context, id int) (report Report, err error) {
+	err = q.db.GetContext(ctx, &report, `
+        SELECT * FROM reports WHERE id = ?
+    `, id)
+	return
+}
+
+func (q SQLiteStorage) ListReports(ctx context.Context, all bool) (reports []Report, err error) {
+	reports = make([]Report, 0)
+	err = q.db.SelectContext(ctx, &reports, `
+        SELECT * FROM reports
+        WHERE ? OR resolved_at IS NULL
+        ORDER BY id DESC
+        LIMIT 500
+    `, all)
+	return
+}
+
+func (q SQLiteStorage) ResolveReport(ctx context.Context, id int, admin, resolution string) error {
+	res, err := q.db.ExecContext(ctx, `
+        UPDATE reports SET resolved_at = CURRENT_TIMESTAMP, resolved_by = ?, resolution = ?
+        WHERE id = ? AND resolved_at IS NULL
+    `, admin, resolution, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (q SQLiteStorage) ResolveRecordReports(ctx context.Context, owner, name, admin, resolution string) error {
+	_, err := q.db.ExecContext(ctx, `
+        UPDATE reports SET resolved_at = CURRENT_TIMESTAMP, resolved_by = ?, resolution = ?
+        WHERE owner = ? AND name = ? AND resolved_at IS NULL
+    `, admin, resolution, owner, name)
+	return err
+}
+
+func (q SQLiteStorage) DenyCID(ctx context.Context, cid, reason string) error {
+	_, err := q.db.ExecContext(ctx, `
+        INSERT INTO denied_cids (cid, reason) VALUES (?1, ?2)
+        ON CONFLICT (cid, record_id) DO UPDATE SET reason = ?2
+    `, cid, reason)
+	return err
+}
+
+func (q SQLiteStorage) AllowCID(ctx context.Context, cid string) error {
+	_, err := q.db.ExecContext(ctx, `
+        DELETE FROM denied_cids WHERE cid = ? AND record_id = 0
+    `, cid)
+	return err
+}
+
+func (q SQLiteStorage) IsCIDDenied(ctx context.Context, cid string) (denied bool, err error) {
+	err = q.db.GetContext(ctx, &denied, `
+        SELECT count(*) > 0 FROM denied_cids WHERE cid = ?
+    `, cid)
+	return
+}
+
+func (q SQLiteStorage) ListDeniedCIDs(ctx context.Context) (cids []DeniedCID, err error) {
+	cids = make([]DeniedCID, 0)
+	err = q.db.SelectContext(ctx, &cids, `
+        SELECT cid, reason, created_at FROM denied_cids ORDER BY created_at DESC
+    `)
+	return
+}
+
+// AddAlias points alias to the record, even if it pointed to another one.
+func (q SQLiteStorage) AddAlias(ctx context.Context, owner, name, alias string) error {
+	res, err := q.db.ExecContext(ctx, `
+        INSERT INTO aliases (owner, name, record_id)
+        SELECT owner, ?3, id FROM head WHERE owner = ?1 AND name = ?2
+        ON CONFLICT (owner, name) DO UPDATE SET record_id = excluded.record_id
+    `, owner, name, alias)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (q SQLiteStorage) RemoveAlias(ctx context.Context, owner, name, alias string) error {
+	res, err := q.db.ExecContext(ctx, `
+        DELETE FROM aliases
+        WHERE owner = ?1 AND name = ?3 AND record_id = (
+          SELECT id FROM head WHERE owner = ?1 AND name = ?2
+        )
+    `, owner, name, alias)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ResolveAlias finds where a record is now, it may have changed owners.
+func (q SQLiteStorage) ResolveAlias(ctx context.Context, owner, alias string) (newOwner, name string, err error) {
+	row := q.db.QueryRowContext(ctx, `
+        SELECT head.owner, head.name FROM aliases
+        INNER JOIN head ON head.id = aliases.record_id
+        WHERE aliases.owner = ? AND aliases.name = ?
+    `, owner, alias)
+	err = row.Scan(&newOwner, &name)
+	return
+}
+
+// OfferTransfer replaces any transfer already waiting for the record.
+func (q SQLiteStorage) OfferTransfer(ctx context.Context, owner, name, recipient string) error {
+	res, err := q.db.ExecContext(ctx, `
+        INSERT INTO transfers (record_id, recipient)
+        SELECT id, ?3 FROM head WHERE owner = ?1 AND name = ?2
+        ON CONFLICT (record_id) DO UPDATE
+          SET recipient = excluded.recipient, created_at = excluded.created_at
+    `, owner, name, recipient)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (q SQLiteStorage) CancelTransfer(ctx context.Context, owner, name string) error {
+	res, err := q.db.ExecContext(ctx, `
+        DELETE FROM transfers
+        WHERE record_id = (SELECT id FROM head WHERE owner = ? AND name = ?)
+    `, owner, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (q SQLiteStorage) GetTransfer(ctx context.Context, owner, name string) (recipient string, err error) {
+	err = q.db.GetContext(ctx, &recipient, `
+        SELECT recipient FROM transfers
+        INNER JOIN head ON head.id = transfers.record_id
+        WHERE owner = ? AND name = ?
+    `, owner, name)
+	return
+}
+
+func (q SQLiteStorage) TransferRecord(ctx context.Context, owner, name, newOwner string) error {
+	txn, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := transferRecord(ctx, txn, owner, name, newOwner); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
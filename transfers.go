@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+)
+
+// offerTransfer starts handing a record to another user, which only happens
+// when they accept it. the current owner can cancel it until then.
+func (s *Server) offerTransfer(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+	name := mux.Vars(r)["name"]
+
+	token := r.Header.Get("Token")
+	err := s.validateJWT(r.Context(), token, owner, map[string]interface{}{
+		"owner": owner,
+		"name":  name,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Str("token", token).
+			Msg("token data is invalid")
+		http.Error(w, "Token data is invalid: "+err.Error(), 401)
+		return
+	}
+
+	if s.rateLimited(w, s.limits.userWrites, owner) {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = s.store.CancelTransfer(r.Context(), owner, name)
+		if err == sql.ErrNoRows {
+			http.Error(w, "There's no pending transfer for "+name+".", 404)
+			return
+		} else if err != nil {
+			log.Warn().Err(err).Str("owner", owner).Str("name", name).
+				Msg("error canceling transfer")
+			http.Error(w, "Error canceling transfer: "+err.Error(), 500)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Missing request body.", 400)
+		return
+	}
+	recipient := gjson.GetBytes(data, "to").String()
+	if recipient == "" {
+		http.Error(w, "Missing recipient.", 400)
+		return
+	}
+	if recipient == owner {
+		http.Error(w, "You already own "+name+".", 400)
+		return
+	}
+
+	account, err := s.store.GetAccount(r.Context(), recipient)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User "+recipient+" not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("recipient", recipient).Msg("error fetching account")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+	if account.SuspendedAt != nil {
+		http.Error(w, "User "+recipient+" is suspended.", 403)
+		return
+	}
+
+	err = s.store.OfferTransfer(r.Context(), owner, name, recipient)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Record not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Str("recipient", recipient).Msg("error offering transfer")
+		http.Error(w, "Error offering transfer: "+err.Error(), 500)
+		return
+	}
+
+	if err := s.sendTransferOffer(owner, name, account); err != nil {
+		// they can still accept it, they just won't be told
+		log.Warn().Err(err).Str("recipient", recipient).
+			Msg("failed to send transfer email")
+	}
+
+	w.WriteHeader(200)
+}
+
+func (s *Server) sendTransferOffer(owner, name string, recipient Account) error {
+	return s.mailer.Send(recipient.Email, owner+" wants to give you "+owner+"/"+name, fmt.Sprintf(
+		`%s wants to transfer the record "%s" at %s to you, "%s".
+
+Its history and stars will come along and the old address will point to its
+new one. To accept it, run:
+
+  gravity transfer accept %s/%s -u %s
+
+`, owner, name, s.ServiceURL, recipient.Name, owner, name, recipient.Name))
+}
+
+// acceptTransfer is signed by the recipient, the record moves to
+// /{recipient}/{name} and /{owner}/{name} becomes an alias to it.
+func (s *Server) acceptTransfer(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+	name := mux.Vars(r)["name"]
+
+	recipient, err := s.store.GetTransfer(r.Context(), owner, name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "There's no pending transfer for "+owner+"/"+name+".", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Msg("error fetching transfer")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	token := r.Header.Get("Token")
+	err = s.validateJWT(r.Context(), token, recipient, map[string]interface{}{
+		"owner":    recipient,
+		"transfer": owner + "/" + name,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Str("recipient", recipient).Str("token", token).
+			Msg("token data is invalid")
+		http.Error(w, "Token data is invalid: "+err.Error(), 401)
+		return
+	}
+
+	if s.rateLimited(w, s.limits.userWrites, recipient) {
+		return
+	}
+
+	if !s.requireVerified(w, r, recipient, "Confirm your email address before accepting records.") {
+		return
+	}
+
+	_, err = s.store.RecordCID(r.Context(), recipient, name)
+	if err == nil {
+		http.Error(w, "You already have a record named "+name+".", 409)
+		return
+	} else if err != sql.ErrNoRows {
+		log.Warn().Err(err).Str("owner", recipient).Str("name", name).
+			Msg("error fetching stuff from database")
+		http.Error(w, "Error fetching data.", 500)
+		return
+	}
+
+	if s.MaxRecordsPerUser > 0 {
+		count, err := s.store.CountRecords(r.Context(), recipient)
+		if err != nil {
+			log.Warn().Err(err).Str("owner", recipient).
+				Msg("error checking record quota")
+			http.Error(w, "Error fetching data.", 500)
+			return
+		}
+		if count >= s.MaxRecordsPerUser {
+			http.Error(w, fmt.Sprintf("Quota exceeded: you can't have more than %d records.",
+				s.MaxRecordsPerUser), 403)
+			return
+		}
+	}
+
+	err = s.store.TransferRecord(r.Context(), owner, name, recipient)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Str("name", name).
+			Str("recipient", recipient).Msg("error transferring record")
+		http.Error(w, "Error transferring record: "+err.Error(), 500)
+		return
+	}
+
+	log.Info().Str("owner", owner).Str("name", name).Str("recipient", recipient).
+		Msg("record transferred")
+
+	// queue for delivery to the activitypub followers of the recipient
+	s.pubDispatchTransfer(recipient, name)
+	w.WriteHeader(200)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func newVerificationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Server) sendVerification(owner, email, token string) error {
+	link := s.ServiceURL + "/verify/" + owner + "/" + token
+	return s.mailer.Send(email, "Confirm your "+s.ServiceName+" account", fmt.Sprintf(
+		`Someone, hopefully you, registered the name "%s" at %s with this email address.
+
+To confirm it, open this link:
+
+  %s
+
+Accounts that aren't confirmed in %s can't publish records.
+`, owner, s.ServiceURL, link, s.VerificationGracePeriod))
+}
+
+func (s *Server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	owner := mux.Vars(r)["owner"]
+	token := mux.Vars(r)["token"]
+
+	ok, err := s.store.VerifyEmail(r.Context(), owner, token)
+	if err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error verifying email")
+		http.Error(w, "Error verifying email.", 500)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or already used verification link.", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Your email address is confirmed, %s.\n", owner)
+}
+
+// unverified is true when owner has been registered for longer than the
+// grace period without confirming the email address.
+func (s *Server) unverified(r *http.Request, owner string) (bool, error) {
+	account, err := s.store.GetAccount(r.Context(), owner)
+	if err != nil {
+		return false, err
+	}
+
+	return account.VerifiedAt == nil &&
+		time.Since(account.CreatedAt) > s.VerificationGracePeriod, nil
+}
+
+// requireVerified is for everything that publishes something, it responds
+// with an error and returns false when owner can't do it.
+func (s *Server) requireVerified(w http.ResponseWriter, r *http.Request, owner, message string) bool {
+	if unverified, err := s.unverified(r, owner); err != nil {
+		log.Warn().Err(err).Str("owner", owner).Msg("error fetching account")
+		http.Error(w, "Error fetching data.", 500)
+		return false
+	} else if unverified {
+		http.Error(w, message, 403)
+		return false
+	}
+	return true
+}
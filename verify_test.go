@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestUnverified(t *testing.T) {
+	ts := newTestServer(t)
+
+	// registered, but the link in the email is never followed
+	carol := &testUser{name: "carol", sk: newKey(t)}
+	pk := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&carol.sk.PublicKey),
+	})
+	if w := ts.do("POST", "/carol", "", string(pk), "Email", "carol@example.com"); w.Code != 200 {
+		t.Fatalf("couldn't register carol: %d %s", w.Code, w.Body.String())
+	}
+
+	carolx := jwt.MapClaims{"owner": "carol", "name": "x"}
+
+	ts.run([]apiTest{
+		{
+			name: "put during the grace period", method: "PUT", path: "/carol/x",
+			user: carol, claims: carolx,
+			body: `{"cid":"` + testCID1 + `"}`, status: 200,
+		},
+	})
+
+	ts.VerificationGracePeriod = 0
+
+	ts.run([]apiTest{
+		{
+			name: "put", method: "PUT", path: "/carol/x",
+			user: carol, claims: carolx,
+			body: `{"cid":"` + testCID2 + `"}`, status: 403,
+		},
+		{
+			name: "edit", method: "PATCH", path: "/carol/x",
+			user: carol, claims: carolx,
+			body: `{"note":"changed"}`, status: 403,
+		},
+		{
+			name: "rename", method: "PATCH", path: "/carol/x",
+			user: carol, claims: carolx,
+			body: `{"name":"y"}`, status: 403,
+		},
+		{
+			name: "add an alias", method: "PUT", path: "/carol/x/aliases/y",
+			user: carol, claims: carolx, status: 403,
+		},
+		{
+			name: "delete", method: "DELETE", path: "/carol/x",
+			user: carol, claims: carolx, status: 200,
+		},
+	})
+}
@@ -1,54 +1,162 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
 type WebfingerResponse struct {
 	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
 	Links   []WebfingerLink `json:"links"`
 }
 
 type WebfingerLink struct {
-	Rel  string `json:"rel"`
-	Type string `json:"type"`
-	Href string `json:"href"`
+	Rel      string `json:"rel" xml:"rel,attr"`
+	Type     string `json:"type,omitempty" xml:"type,attr,omitempty"`
+	Href     string `json:"href,omitempty" xml:"href,attr,omitempty"`
+	Template string `json:"template,omitempty" xml:"template,attr,omitempty"`
 }
 
-func webfinger(w http.ResponseWriter, r *http.Request) {
+type HostMeta struct {
+	XMLName xml.Name        `xml:"http://docs.oasis-open.org/ns/xri/xrd-1.0 XRD" json:"-"`
+	Links   []WebfingerLink `xml:"Link" json:"links"`
+}
+
+func (s *Server) webfinger(w http.ResponseWriter, r *http.Request) {
 	rsc := r.URL.Query().Get("resource")
-	parts := strings.Split(rsc, "acct:")
-	if len(parts) != 2 {
+
+	host := s.ServiceURL
+	if u, err := url.Parse(s.ServiceURL); err == nil {
+		host = u.Host
+	}
+
+	// resources can be acct:name@host or the urls of the actor or profile
+	var name string
+	switch {
+	case strings.HasPrefix(rsc, "acct:"):
+		parts := strings.Split(strings.TrimPrefix(rsc, "acct:"), "@")
+		if len(parts) != 2 {
+			http.Error(w, "Wrong Webfinger resource query.", 400)
+			return
+		}
+		if parts[1] != host {
+			http.Error(w, "Resource not on this server.", 404)
+			return
+		}
+		name = parts[0]
+	case strings.HasPrefix(rsc, s.ServiceURL+"/pub/user/"):
+		name = strings.TrimPrefix(rsc, s.ServiceURL+"/pub/user/")
+	case strings.HasPrefix(rsc, s.ServiceURL+"/"):
+		name = strings.TrimPrefix(rsc, s.ServiceURL+"/")
+	default:
 		http.Error(w, "Wrong Webfinger resource query.", 400)
 		return
 	}
 
-	account := parts[1]
-	parts = strings.Split(account, "@")
-	if len(parts) != 2 {
-		http.Error(w, "Wrong Webfinger resource query.", 400)
+	var exists bool
+	err := s.pg.GetContext(r.Context(), &exists, `SELECT true FROM users WHERE name = $1`, name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found.", 404)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("name", name).Msg("error fetching user for webfinger")
+		http.Error(w, "Error fetching data.", 500)
 		return
 	}
 
-	name := parts[0]
-	server := parts[1]
+	links := []WebfingerLink{
+		{
+			Rel:  "self",
+			Type: "application/activity+json",
+			Href: s.ServiceURL + "/pub/user/" + name,
+		},
+		{
+			Rel:  "http://webfinger.net/rel/profile-page",
+			Type: "text/html",
+			Href: s.ServiceURL + "/" + name,
+		},
+		{
+			Rel:  "http://schemas.google.com/g/2010#updates-from",
+			Type: "application/atom+xml",
+			Href: s.ServiceURL + "/" + name + ".atom",
+		},
+		{
+			Rel:      "http://ostatus.org/schema/1.0/subscribe",
+			Template: s.ServiceURL + "/authorize_interaction?uri={uri}",
+		},
+	}
 
-	if !strings.HasSuffix(s.ServiceURL, server) {
-		http.Error(w, "Wrong Webfinger resource query.", 400)
-		return
+	// only the requested rels, if any were requested
+	if rels := r.URL.Query()["rel"]; len(rels) > 0 {
+		filtered := make([]WebfingerLink, 0, len(links))
+		for _, link := range links {
+			for _, rel := range rels {
+				if link.Rel == rel {
+					filtered = append(filtered, link)
+					break
+				}
+			}
+		}
+		links = filtered
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/jrd+json")
 	json.NewEncoder(w).Encode(WebfingerResponse{
-		Subject: rsc,
+		Subject: "acct:" + name + "@" + host,
+		Aliases: []string{
+			s.ServiceURL + "/pub/user/" + name,
+			s.ServiceURL + "/" + name,
+		},
+		Links: links,
+	})
+}
+
+func (s *Server) hostMeta(w http.ResponseWriter, r *http.Request) {
+	meta := HostMeta{
 		Links: []WebfingerLink{
 			{
-				Rel:  "self",
-				Type: "application/activity+json",
-				Href: s.ServiceURL + "/pub/user/" + name,
+				Rel:      "lrdd",
+				Type:     "application/jrd+json",
+				Template: s.ServiceURL + "/.well-known/webfinger?resource={uri}",
 			},
 		},
-	})
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if strings.HasSuffix(r.URL.Path, ".json") ||
+		strings.Contains(r.Header.Get("Accept"), "json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(meta)
+		return
+	}
+
+	meta.Links[0].Type = "application/xrd+xml"
+	w.Header().Set("Content-Type", "application/xrd+xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(meta); err != nil {
+		log.Warn().Err(err).Msg("error encoding host-meta")
+	}
+}
+
+// authorizeInteraction is where remote follow buttons send people who want
+// to follow someone from their gravity account.
+func (s *Server) authorizeInteraction(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		http.Error(w, "Missing uri.", 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "To follow %s from %s, run:\n\n  gravity follow %s -u <your name>\n",
+		uri, s.ServiceName, uri)
 }